@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// Time the last message of the backlog was received, in Unix nanoseconds
+var lastBacklogMessage atomic.Int64
+
+// inBacklog reports whether the message was published before the process
+// started, noting when the last such message was received
+func inBacklog(msg *pubsub.Message) bool {
+	if !msg.PublishTime.Before(startTime) {
+		return false
+	}
+
+	lastBacklogMessage.Store(time.Now().UnixNano())
+	return true
+}
+
+// stopWhenCaughtUp with the backlog, by cancelling once no message of the
+// backlog has been received for -backlog-exit-after
+func stopWhenCaughtUp(ctx context.Context, cancel context.CancelFunc) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		last := time.Unix(0, lastBacklogMessage.Load())
+		if last.Before(startTime) {
+			last = startTime
+		}
+		if time.Since(last) >= *flagBacklogExitAfter {
+			logger.Info("caught up with the backlog, stopping", "idle", time.Since(last).Round(time.Second).String())
+			cancel()
+			return
+		}
+	}
+}
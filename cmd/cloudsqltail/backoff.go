@@ -0,0 +1,51 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Jitter strategies of the retry backoff, as given to -retry-jitter
+const (
+	retryJitterFull  = "full"
+	retryJitterEqual = "equal"
+	retryJitterNone  = "none"
+)
+
+// jitter of the retry backoff, a random duration in [0, n), which tests replace
+var jitter = rand.Int63n
+
+// retryBackoff of the given attempt at an operation, the first retry being
+// attempt 1: exponential from -retry-backoff-base by -retry-backoff-multiplier,
+// capped at -retry-backoff-max, and jittered by -retry-jitter so that a fleet
+// retrying after the same failure does not retry in lockstep
+func retryBackoff(attempt int) time.Duration {
+	d := retryBackoffCeiling(attempt)
+	switch *flagRetryJitter {
+	case retryJitterFull:
+		return time.Duration(jitter(int64(d) + 1))
+	case retryJitterEqual:
+		return d/2 + time.Duration(jitter(int64(d/2)+1))
+	default:
+		return d
+	}
+}
+
+// retryBackoffCeiling of the given attempt, the backoff before any jitter
+func retryBackoffCeiling(attempt int) time.Duration {
+	d := float64(*flagRetryBackoffBase) * math.Pow(*flagRetryBackoffMultiplier, float64(attempt-1))
+	if d > float64(*flagRetryBackoffMax) {
+		return *flagRetryBackoffMax
+	}
+	return time.Duration(d)
+}
+
+// retryBackoffTotal of the given number of retries at most, before jitter
+func retryBackoffTotal(retries int) time.Duration {
+	var total time.Duration
+	for attempt := 1; attempt <= retries; attempt++ {
+		total += retryBackoffCeiling(attempt)
+	}
+	return total
+}
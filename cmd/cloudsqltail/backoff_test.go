@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// stubJitter of the retry backoff for a test, always picking the lowest or
+// the highest duration
+func stubJitter(t *testing.T, highest bool) {
+	t.Helper()
+	jitter = func(n int64) int64 {
+		if highest {
+			return n - 1
+		}
+		return 0
+	}
+	t.Cleanup(func() { jitter = rand.Int63n })
+}
+
+func TestRetryBackoffCeiling(t *testing.T) {
+	setFlag(t, "retry-backoff-base", "100ms")
+	setFlag(t, "retry-backoff-max", "1s")
+
+	tests := []struct {
+		multiplier string
+		want       []time.Duration
+	}{
+		{multiplier: "1", want: []time.Duration{100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond}},
+		{multiplier: "2", want: []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}},
+		{multiplier: "1.5", want: []time.Duration{100 * time.Millisecond, 150 * time.Millisecond, 225 * time.Millisecond}},
+		{multiplier: "10", want: []time.Duration{100 * time.Millisecond, time.Second, time.Second}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.multiplier, func(t *testing.T) {
+			setFlag(t, "retry-backoff-multiplier", tt.multiplier)
+			var total time.Duration
+			for i, want := range tt.want {
+				if got := retryBackoffCeiling(i + 1); got != want {
+					t.Errorf("attempt %d: got %s, want %s", i+1, got, want)
+				}
+				total += want
+			}
+			if got := retryBackoffTotal(len(tt.want)); got != total {
+				t.Errorf("got total %s, want %s", got, total)
+			}
+		})
+	}
+
+	if got := retryBackoffTotal(0); got != 0 {
+		t.Errorf("got total %s without retries, want 0", got)
+	}
+}
+
+func TestRetryBackoffJitter(t *testing.T) {
+	setFlag(t, "retry-backoff-base", "100ms")
+	setFlag(t, "retry-backoff-max", "1s")
+	setFlag(t, "retry-backoff-multiplier", "2")
+
+	// The third attempt is at 400ms before jitter
+	tests := []struct {
+		jitter string
+		low    time.Duration
+		high   time.Duration
+	}{
+		{jitter: retryJitterFull, low: 0, high: 400 * time.Millisecond},
+		{jitter: retryJitterEqual, low: 200 * time.Millisecond, high: 400 * time.Millisecond},
+		{jitter: retryJitterNone, low: 400 * time.Millisecond, high: 400 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.jitter, func(t *testing.T) {
+			setFlag(t, "retry-jitter", tt.jitter)
+			stubJitter(t, false)
+			if got := retryBackoff(3); got != tt.low {
+				t.Errorf("got lowest %s, want %s", got, tt.low)
+			}
+			stubJitter(t, true)
+			if got := retryBackoff(3); got != tt.high {
+				t.Errorf("got highest %s, want %s", got, tt.high)
+			}
+
+			// Capped before the jitter is applied
+			if got := retryBackoff(10); got > time.Second {
+				t.Errorf("got %s past the max", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Set while the buffer depth is above the high-water mark and intake is being
+// throttled, until it drops back to the low-water mark. Protected by the lock
+// on the messages slice.
+var throttled bool
+
+// Set while receiving is paused through /pause, until /resume. Protected by
+// the lock on the messages slice.
+var paused bool
+
+// Semaphore allowing a single Receive callback at a time while throttled
+var throttle = make(chan struct{}, 1)
+
+// admit a received message into the pipeline, waiting for other throttled
+// callbacks first while the buffer is above its high-water mark. The returned
+// function must be called once the message has been handled.
+func admit() func() {
+	buffer.mx.Lock()
+	t := throttled
+	buffer.mx.Unlock()
+
+	if !t {
+		return func() {}
+	}
+
+	throttle <- struct{}{}
+	return func() { <-throttle }
+}
+
+// updateThrottle after the buffer depth changed, reporting it in the
+// buffer_depth gauge, and starting to throttle above the high-water mark and
+// stopping at the low-water mark. The lock on the messages slice must be held.
+func updateThrottle(depth int) {
+	metricBufferDepth.Set(float64(depth))
+	if *flagHighWaterMark == 0 {
+		return
+	}
+
+	switch {
+	case !throttled && depth > *flagHighWaterMark:
+		throttled = true
+		metricReceiveThrottled.Set(1)
+	case throttled && depth <= *flagLowWaterMark:
+		throttled = false
+		metricReceiveThrottled.Set(0)
+	}
+}
+
+// servePause handler of the POST requests pausing or resuming receiving. While
+// paused, received messages are held back before being buffered, so that
+// Pub/Sub applies back pressure, and flushing carries on.
+func servePause(pause bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		buffer.mx.Lock()
+		if paused != pause {
+			paused = pause
+			logger.Info("receiving paused through the HTTP server", "paused", paused)
+		}
+		if !paused {
+			buffer.intakeResumed.Broadcast()
+		}
+		buffer.mx.Unlock()
+
+		serveStatus(w, r)
+	}
+}
+
+// serveStatus of the intake as JSON
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	buffer.mx.Lock()
+	status := map[string]interface{}{
+		"paused":         paused,
+		"throttled":      throttled,
+		"output_failing": outputFailing,
+	}
+	buffer.mx.Unlock()
+	status["messages"] = Stats()
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	// The client went away, which is no reason to stop tailing
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		logger.Warn("could not return HTTP response", "path", r.URL.Path, "error", err)
+	}
+}
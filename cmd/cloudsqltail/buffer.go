@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"cloudsqltail/messages"
+)
+
+// Buffer of the messages received, until they are flushed to its output. Its
+// lock also protects the state of the pipeline documented as protected by the
+// lock on the messages slice.
+type Buffer struct {
+	// Mutex used to protect the messages slice
+	mx sync.Mutex
+
+	// Used to store messages until they are flushed
+	msgs []messages.ParsedMessage
+
+	// Total size of the payloads in the messages slice
+	bytes int
+
+	// Where flushed messages are written
+	out io.Writer
+
+	// Time of the last flush that wrote anything
+	lastFlush time.Time
+
+	// Time spent writing out the last flush
+	lastFlushDuration time.Duration
+
+	// Watermark of the last flush, older messages arriving after it are late
+	lastWatermark time.Time
+
+	// Set while the last write failed and its batch was dropped by
+	// -on-output-error=drop
+	lastWriteDropped bool
+
+	// Signalled when writing the output recovers or receiving is resumed, to
+	// let held messages in
+	intakeResumed *sync.Cond
+
+	// Signalled when a flush frees up space in the messages slice
+	bufferFreed *sync.Cond
+}
+
+// NewBuffer of messages flushed to the given output
+func NewBuffer(out io.Writer) *Buffer {
+	buf := &Buffer{out: out, lastFlush: time.Now()}
+	buf.intakeResumed = sync.NewCond(&buf.mx)
+	buf.bufferFreed = sync.NewCond(&buf.mx)
+	return buf
+}
+
+// The buffer of the process, created by main once the output is open, that the
+// sources, signals and HTTP server use
+var buffer *Buffer
+
+// Len of the messages slice
+func (buf *Buffer) Len() int {
+	buf.mx.Lock()
+	defer buf.mx.Unlock()
+
+	return len(buf.msgs)
+}
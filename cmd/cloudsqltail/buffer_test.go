@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// newTestBuffer flushed to the returned output, with the ordering state of
+// the previous tests forgotten and timestamps written in UTC, as parseFlags
+// would by default
+func newTestBuffer(t *testing.T) (*Buffer, *bytes.Buffer) {
+	t.Helper()
+	timestampLocation = time.UTC
+	lastKeySortTime = map[string]time.Time{}
+	t.Cleanup(func() { lastKeySortTime = map[string]time.Time{} })
+
+	var out bytes.Buffer
+	return NewBuffer(&out), &out
+}
+
+func TestBufferFlush(t *testing.T) {
+	tests := []struct {
+		name     string
+		received []string
+		want     string
+	}{
+		{
+			name:     "empty",
+			received: nil,
+			want:     "",
+		},
+		{
+			name: "sorted by timestamp",
+			received: []string{
+				`{"timestamp":"2021-06-01T10:00:02Z","textPayload":"[1]: second"}`,
+				`{"timestamp":"2021-06-01T10:00:01Z","textPayload":"[1]: first"}`,
+				`{"timestamp":"2021-06-01T10:00:03Z","textPayload":"[1]: third"}`,
+			},
+			want: "[2021-06-01 10:00:01 UTC]: [1]: first\n" +
+				"[2021-06-01 10:00:02 UTC]: [1]: second\n" +
+				"[2021-06-01 10:00:03 UTC]: [1]: third\n",
+		},
+		{
+			name: "insert ID breaks timestamp ties",
+			received: []string{
+				`{"insertId":"b","timestamp":"2021-06-01T10:00:01Z","textPayload":"[1]: b"}`,
+				`{"insertId":"a","timestamp":"2021-06-01T10:00:01Z","textPayload":"[1]: a"}`,
+			},
+			want: "[2021-06-01 10:00:01 UTC]: [1]: a\n" +
+				"[2021-06-01 10:00:01 UTC]: [1]: b\n",
+		},
+		{
+			name: "continuation lines have no timestamp",
+			received: []string{
+				`{"timestamp":"2021-06-01T10:00:01Z","textPayload":"[1]: SELECT *"}`,
+				`{"timestamp":"2021-06-01T10:00:02Z","textPayload":"\tFROM t"}`,
+			},
+			want: "[2021-06-01 10:00:01 UTC]: [1]: SELECT *\n" +
+				"\tFROM t\n",
+		},
+		{
+			name: "empty payloads are skipped",
+			received: []string{
+				`{"timestamp":"2021-06-01T10:00:01Z","textPayload":""}`,
+				`{"timestamp":"2021-06-01T10:00:02Z","textPayload":"[1]: kept"}`,
+				`{"timestamp":"2021-06-01T10:00:03Z"}`,
+			},
+			want: "[2021-06-01 10:00:02 UTC]: [1]: kept\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, out := newTestBuffer(t)
+			for _, data := range tt.received {
+				if !buf.Add([]byte(data), "", "", "") {
+					t.Fatalf("message not acknowledged: %s", data)
+				}
+			}
+
+			buf.Flush(false)
+			if got := out.String(); got != tt.want {
+				t.Errorf("flushed\n%q\nwant\n%q", got, tt.want)
+			}
+			if buf.Len() != 0 {
+				t.Errorf("%d messages left in the buffer", buf.Len())
+			}
+		})
+	}
+}
+
+func TestBufferHoldsBackNewerThanWatermark(t *testing.T) {
+	buf, out := newTestBuffer(t)
+	setFlag(t, "lateness", "1h")
+
+	old := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339Nano)
+	recent := time.Now().UTC().Format(time.RFC3339Nano)
+	buf.Add([]byte(`{"timestamp":"`+recent+`","textPayload":"[1]: recent"}`), "", "", "")
+	buf.Add([]byte(`{"timestamp":"`+old+`","textPayload":"[1]: old"}`), "", "", "")
+
+	buf.Flush(false)
+	if !bytes.Contains(out.Bytes(), []byte("[1]: old")) || bytes.Contains(out.Bytes(), []byte("[1]: recent")) {
+		t.Fatalf("flushed %q, want only the old message", out.String())
+	}
+
+	// Draining flushes everything left
+	out.Reset()
+	buf.Flush(true)
+	if !bytes.Contains(out.Bytes(), []byte("[1]: recent")) {
+		t.Fatalf("drained %q, want the recent message", out.String())
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config read from a YAML or JSON file given by -config, mapping option names
+// (the flag names, without the leading dash) to their values. A list of values
+// sets a repeatable option once per value.
+type Config map[string]interface{}
+
+// loadConfig from the given file, YAML being a superset of JSON
+func loadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.New(fmt.Sprintf("could not parse config file '%s': %s", path, err.Error()))
+	}
+
+	return cfg, nil
+}
+
+// apply the values of the config to the flags that were not set on the
+// command line, which always take precedence
+func (cfg Config) apply() error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	for name, value := range cfg {
+		if flag.Lookup(name) == nil || name == "config" {
+			return errors.New(fmt.Sprintf("unknown option '%s' in config file", name))
+		}
+		if explicit[name] {
+			continue
+		}
+
+		if err := setOption(name, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Prefix of the environment variables options can be set from
+const envPrefix = "CLOUDSQLTAIL_"
+
+// envName of the environment variable setting an option, e.g.
+// CLOUDSQLTAIL_FLUSH_INTERVAL for -flush-interval
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnv sets the flags that were not set on the command line from their
+// environment variables. It runs before the config file is applied, which
+// then leaves these flags alone too.
+func applyEnv() error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] {
+			return
+		}
+
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if setErr := flag.Set(f.Name, value); setErr != nil {
+			err = errors.New(fmt.Sprintf("invalid value '%s' for %s: %s", value, envName(f.Name), setErr.Error()))
+		}
+	})
+
+	return err
+}
+
+// configValues of an option in the config file, a list setting a repeatable
+// option once per value
+func configValues(value interface{}) []interface{} {
+	values, ok := value.([]interface{})
+	if !ok {
+		values = []interface{}{value}
+	}
+	return values
+}
+
+// setOption to the value it has in the config file
+func setOption(name string, value interface{}) error {
+	for _, v := range configValues(value) {
+		if err := flag.Set(name, fmt.Sprint(v)); err != nil {
+			return errors.New(fmt.Sprintf("invalid value '%v' for option '%s' in config file: %s", v, name, err.Error()))
+		}
+	}
+
+	return nil
+}
+
+// Options holding credentials, whose values are redacted from the resolved
+// config when set
+var secretOptions = map[string]bool{
+	"honeycomb-writekey": true,
+	"http-bearer-token":  true,
+}
+
+// resolvedConfig of all options, as set by the flags, the config file or
+// their defaults. Durations are given as strings, so that the result can be
+// used as a config file again, once the redacted credentials are filled in.
+func resolvedConfig() Config {
+	cfg := make(Config)
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "print-config-json" || f.Name == "version" {
+			return
+		}
+
+		if secretOptions[f.Name] && f.Value.String() != "" {
+			cfg[f.Name] = "[REDACTED]"
+			return
+		}
+
+		switch v := f.Value.(type) {
+		case *stringsFlag:
+			if f.Name == "http-header" {
+				cfg[f.Name] = redactedHeaders(*v)
+				return
+			}
+			cfg[f.Name] = append([]string{}, *v...)
+		case flag.Getter:
+			value := v.Get()
+			if d, ok := value.(time.Duration); ok {
+				value = d.String()
+			}
+			cfg[f.Name] = value
+		default:
+			cfg[f.Name] = v.String()
+		}
+	})
+
+	return cfg
+}
+
+// redactedHeaders of -http-header, whose values may hold credentials, leaving
+// only their names
+func redactedHeaders(headers []string) []string {
+	redacted := make([]string, 0, len(headers))
+	for _, h := range headers {
+		k, _, _ := strings.Cut(h, "=")
+		redacted = append(redacted, k+"=[REDACTED]")
+	}
+	return redacted
+}
+
+// print the config as indented JSON, ordered by option name
+func (cfg Config) print(w io.Writer) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestResolvedConfigRedactsSecrets(t *testing.T) {
+	setFlag(t, "http-bearer-token", "secret-token")
+	previous := flagHTTPHeaders
+	flagHTTPHeaders = stringsFlag{"Authorization=Basic c2VjcmV0", "X-API-Key=secret-key", "X-Empty="}
+	t.Cleanup(func() { flagHTTPHeaders = previous })
+
+	want := "[Authorization=[REDACTED] X-API-Key=[REDACTED] X-Empty=[REDACTED]]"
+	cfg := resolvedConfig()
+	if got := fmt.Sprint(cfg["http-header"]); got != want {
+		t.Errorf("got headers %s, want %s", got, want)
+	}
+	if got := cfg["http-bearer-token"]; got != "[REDACTED]" {
+		t.Errorf("got bearer token %v, want it redacted", got)
+	}
+	if got := cfg["honeycomb-writekey"]; got != "" {
+		t.Errorf("got unset write key %v, want it empty", got)
+	}
+
+	// The debug state shows the same
+	buf, _ := newTestBuffer(t)
+	if got := fmt.Sprint(snapshot(buf).Config["http-header"]); got != want {
+		t.Errorf("got debug state headers %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"cloudsqltail/messages"
+)
+
+// coalesceContinuations of the sorted messages of a flush, appending the
+// payloads of the continuation lines of each entry to its first line, joined
+// by newlines. Continuation lines with no first line before them in the flush
+// are kept as they are. Unless draining, the last entry is held back for the
+// next flush if its first line was received since the given time, as more of
+// its lines may still be on their way.
+func coalesceContinuations(msgs []messages.ParsedMessage, drain bool, since time.Time) (coalesced, held []messages.ParsedMessage) {
+	last := -1
+	for i := range msgs {
+		if msgs[i].StartsEntry() {
+			last = i
+		}
+	}
+	if last >= 0 && !drain && msgs[last].Received.After(since) {
+		held = append(held, msgs[last:]...)
+		msgs = msgs[:last]
+	}
+
+	first := -1
+	var payloads []string
+	coalesced = msgs[:0]
+	join := func() {
+		if len(payloads) > 1 {
+			coalesced[first].TextPayload = strings.Join(payloads, "\n")
+		}
+	}
+	for _, msg := range msgs {
+		if msg.StartsEntry() {
+			join()
+			first, payloads = len(coalesced), []string{msg.TextPayload}
+			coalesced = append(coalesced, msg)
+			continue
+		}
+		if first < 0 || msg.TextPayload == "" {
+			coalesced = append(coalesced, msg)
+			continue
+		}
+
+		payloads = append(payloads, msg.TextPayload)
+	}
+	join()
+
+	return coalesced, held
+}
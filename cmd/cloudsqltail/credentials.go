@@ -0,0 +1,20 @@
+package main
+
+import (
+	"google.golang.org/api/option"
+)
+
+// credentialOptions for the Google API clients, from -credentials-file and
+// -impersonate-service-account, or none to use the application default
+// credentials
+func credentialOptions() []option.ClientOption {
+	var opts []option.ClientOption
+	if *flagCredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(*flagCredentialsFile))
+	}
+	if *flagImpersonateServiceAccount != "" {
+		opts = append(opts, option.ImpersonateCredentials(*flagImpersonateServiceAccount))
+	}
+
+	return opts
+}
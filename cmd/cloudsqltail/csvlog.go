@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Columns of the Postgres csvlog format, in order. Older versions leave out
+// the last ones.
+var csvlogColumns = []string{
+	"log_time",
+	"user_name",
+	"database_name",
+	"process_id",
+	"connection_from",
+	"session_id",
+	"session_line_num",
+	"command_tag",
+	"session_start_time",
+	"virtual_transaction_id",
+	"transaction_id",
+	"error_severity",
+	"sql_state_code",
+	"message",
+	"detail",
+	"hint",
+	"internal_query",
+	"internal_query_pos",
+	"context",
+	"query",
+	"query_pos",
+	"location",
+	"application_name",
+	"backend_type",
+	"leader_pid",
+	"query_id",
+}
+
+// Number of columns up to the message, the least a csvlog row can have
+const csvlogMinColumns = 14
+
+// Columns of the csvlog format that hold integers
+var csvlogIntColumns = map[string]bool{
+	"process_id":         true,
+	"session_line_num":   true,
+	"transaction_id":     true,
+	"internal_query_pos": true,
+	"query_pos":          true,
+	"leader_pid":         true,
+	"query_id":           true,
+}
+
+// parseCSVLog payload as a single row of the Postgres csvlog format, into
+// the fields of its non-empty columns. Quoted columns may span several lines.
+// Reports false if the payload is not such a row.
+func parseCSVLog(payload string) ([]field, bool) {
+	r := csv.NewReader(strings.NewReader(payload))
+	r.FieldsPerRecord = -1
+
+	row, err := r.Read()
+	if err != nil || len(row) < csvlogMinColumns || len(row) > len(csvlogColumns) {
+		return nil, false
+	}
+	if _, err := r.Read(); err != io.EOF {
+		return nil, false
+	}
+
+	fields := make([]field, 0, len(row))
+	for i, value := range row {
+		if value == "" {
+			continue
+		}
+
+		name := csvlogColumns[i]
+		if csvlogIntColumns[name] {
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+				fields = append(fields, field{name, n})
+				continue
+			}
+		}
+		fields = append(fields, field{name, value})
+	}
+
+	return fields, true
+}
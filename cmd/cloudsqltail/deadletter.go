@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+var (
+	// File that rejected messages are appended to, if configured
+	deadletterFile *os.File
+
+	// Mutex used to protect the deadletter file
+	deadletterMx sync.Mutex
+)
+
+// openDeadletter file given by -deadletter-file for appending, if one is set
+func openDeadletter() error {
+	if *flagDeadletterFile == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(*flagDeadletterFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	deadletterFile = f
+	return nil
+}
+
+// deadletter the raw data of a rejected message by appending it, one per line,
+// to the deadletter file. This is a no-op if no deadletter file is configured.
+func deadletter(data []byte) {
+	deadletterMx.Lock()
+	defer deadletterMx.Unlock()
+
+	if deadletterFile == nil {
+		return
+	}
+
+	line := make([]byte, 0, len(data)+1)
+	line = append(append(line, data...), '\n')
+	if _, err := deadletterFile.Write(line); err != nil {
+		logger.Error("could not write to deadletter file", "error", err)
+	}
+}
+
+// closeDeadletter file, if one is open
+func closeDeadletter() {
+	deadletterMx.Lock()
+	defer deadletterMx.Unlock()
+
+	if deadletterFile == nil {
+		return
+	}
+
+	if err := deadletterFile.Close(); err != nil {
+		logger.Error("could not close deadletter file", "error", err)
+	}
+	deadletterFile = nil
+}
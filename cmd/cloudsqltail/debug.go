@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// state of the process returned by /debug/state, without any payload content
+type state struct {
+	BufferedMessages  int       `json:"buffered_messages"`
+	BufferedBytes     int       `json:"buffered_bytes"`
+	OldestBuffered    time.Time `json:"oldest_buffered"`
+	NewestBuffered    time.Time `json:"newest_buffered"`
+	OutputFailing     bool      `json:"output_failing"`
+	Paused            bool      `json:"paused"`
+	Throttled         bool      `json:"throttled"`
+	LastFlush         time.Time `json:"last_flush"`
+	LastFlushDuration string    `json:"last_flush_duration"`
+	StatsSnapshot
+	Uptime string `json:"uptime"`
+	Config Config `json:"config"`
+}
+
+// snapshot of the current state of the buffer, holding the lock only to read
+// it
+func snapshot(buf *Buffer) state {
+	buf.mx.Lock()
+	s := state{
+		BufferedMessages:  len(buf.msgs),
+		BufferedBytes:     buf.bytes,
+		OutputFailing:     outputFailing,
+		Paused:            paused,
+		Throttled:         throttled,
+		LastFlush:         buf.lastFlush,
+		LastFlushDuration: buf.lastFlushDuration.String(),
+	}
+	for i := range buf.msgs {
+		ts := buf.msgs[i].Timestamp
+		if s.OldestBuffered.IsZero() || ts.Before(s.OldestBuffered) {
+			s.OldestBuffered = ts
+		}
+		if ts.After(s.NewestBuffered) {
+			s.NewestBuffered = ts
+		}
+	}
+	buf.mx.Unlock()
+
+	s.StatsSnapshot = Stats()
+	s.Uptime = time.Since(startTime).Round(time.Second).String()
+
+	s.Config = resolvedConfig()
+
+	return s
+}
+
+// serveDebugState as JSON on /debug/state
+func serveDebugState(w http.ResponseWriter, r *http.Request) {
+	data, err := json.MarshalIndent(snapshot(buffer), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	// The client went away, which is no reason to stop tailing
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		logger.Warn("could not return HTTP response", "path", r.URL.Path, "error", err)
+	}
+}
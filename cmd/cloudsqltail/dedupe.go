@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"cloudsqltail/messages"
+)
+
+// Magic number at the start of a persisted dedupe filter, with its version
+const bloomMagic = "cloudsqltail-bloom-1"
+
+// bloomFilter of the insert IDs that were written, answering whether one was
+// seen before with no false negatives and a small rate of false positives
+type bloomFilter struct {
+	bits []uint64
+	k    uint64
+
+	// Number of insert IDs added
+	n uint64
+}
+
+// newBloomFilter sized for the given number of insert IDs at the given false
+// positive rate
+func newBloomFilter(capacity uint64, rate float64) *bloomFilter {
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(rate) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Max(1, math.Round(float64(m)/float64(capacity)*math.Ln2)))
+	return &bloomFilter{bits: make([]uint64, (m+63)/64), k: k}
+}
+
+// positions of the bits of an insert ID, by double hashing
+func (f *bloomFilter) positions(id string) []uint64 {
+	h := fnv.New128a()
+	_, _ = h.Write([]byte(id))
+	sum := h.Sum(nil)
+	h1, h2 := binary.BigEndian.Uint64(sum[:8]), binary.BigEndian.Uint64(sum[8:])
+
+	m := uint64(len(f.bits)) * 64
+	positions := make([]uint64, f.k)
+	for i := range positions {
+		positions[i] = (h1 + uint64(i)*h2) % m
+	}
+	return positions
+}
+
+// add an insert ID to the filter
+func (f *bloomFilter) add(id string) {
+	for _, p := range f.positions(id) {
+		f.bits[p/64] |= 1 << (p % 64)
+	}
+	f.n++
+}
+
+// has reports whether the insert ID was probably added to the filter
+func (f *bloomFilter) has(id string) bool {
+	for _, p := range f.positions(id) {
+		if f.bits[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// writeTo w in the format read by readBloomFilter
+func (f *bloomFilter) writeTo(w io.Writer) error {
+	for _, v := range []uint64{f.k, f.n, uint64(len(f.bits))} {
+		if err := binary.Write(w, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	return binary.Write(w, binary.BigEndian, f.bits)
+}
+
+// Error of readBloomFilter for a filter sized differently than wanted
+var errBloomSize = errors.New("filter sized differently")
+
+// readBloomFilter written by writeTo from r, which must be sized like the
+// wanted one so that a corrupt size is never allocated
+func readBloomFilter(r io.Reader, want *bloomFilter) (*bloomFilter, error) {
+	var k, n, words uint64
+	for _, v := range []*uint64{&k, &n, &words} {
+		if err := binary.Read(r, binary.BigEndian, v); err != nil {
+			return nil, err
+		}
+	}
+	if k != want.k || words != uint64(len(want.bits)) {
+		return nil, errBloomSize
+	}
+
+	f := &bloomFilter{bits: make([]uint64, words), k: k, n: n}
+	if err := binary.Read(r, binary.BigEndian, f.bits); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+var (
+	// Filters of the insert IDs written, with -dedupe-bloom-path. Once the
+	// current one holds -dedupe-bloom-capacity IDs, it becomes the previous
+	// one and a new one is started, so that memory stays constant while the
+	// most recent IDs are always remembered. The lock on the messages slice
+	// must be held.
+	dedupeCurrent, dedupePrevious *bloomFilter
+
+	// Set once IDs were added since the filters were last persisted
+	dedupeDirty bool
+)
+
+// openDedupe filters persisted at -dedupe-bloom-path, if one is set, starting
+// empty ones if there are none yet or they were sized differently
+func openDedupe() error {
+	if *flagDedupeBloomPath == "" {
+		return nil
+	}
+
+	dedupeCurrent = newBloomFilter(*flagDedupeBloomCapacity, *flagDedupeBloomFPRate)
+
+	f, err := os.Open(*flagDedupeBloomPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(bloomMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != bloomMagic {
+		return errors.New(fmt.Sprintf("invalid dedupe filter file '%s'", *flagDedupeBloomPath))
+	}
+	current, err := readBloomFilter(r, dedupeCurrent)
+	if err == nil {
+		var previous *bloomFilter
+		previous, err = readBloomFilter(r, dedupeCurrent)
+		if errors.Is(err, io.EOF) {
+			previous, err = nil, nil
+		}
+		dedupePrevious = previous
+	}
+	if errors.Is(err, errBloomSize) {
+		logger.Warn("dedupe filter file was sized differently, starting over", "path", *flagDedupeBloomPath)
+		return nil
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid dedupe filter file '%s': %s", *flagDedupeBloomPath, err.Error()))
+	}
+
+	dedupeCurrent = current
+	logger.Info("loaded dedupe filter", "path", *flagDedupeBloomPath, "ids", current.n)
+	return nil
+}
+
+// seenBefore reports whether the insert ID of the message was probably
+// written before. The lock on the messages slice must be held.
+func seenBefore(pm *messages.ParsedMessage) bool {
+	if dedupeCurrent == nil || pm.InsertID == "" {
+		return false
+	}
+
+	return dedupeCurrent.has(pm.InsertID) || (dedupePrevious != nil && dedupePrevious.has(pm.InsertID))
+}
+
+// recentIDs of the messages written, the least recently written ones being
+// forgotten past its size, which answers exactly whether an ID is among them
+type recentIDs struct {
+	size  int
+	order *list.List
+	ids   map[string]*list.Element
+}
+
+// newRecentIDs remembering up to size insert IDs
+func newRecentIDs(size int) *recentIDs {
+	return &recentIDs{size: size, order: list.New(), ids: make(map[string]*list.Element, size)}
+}
+
+// has reports whether the insert ID is among the recent ones
+func (r *recentIDs) has(id string) bool {
+	_, ok := r.ids[id]
+	return ok
+}
+
+// add an insert ID as the most recent one, forgetting the least recent one
+// if there are too many
+func (r *recentIDs) add(id string) {
+	if e, ok := r.ids[id]; ok {
+		r.order.MoveToFront(e)
+		return
+	}
+
+	r.ids[id] = r.order.PushFront(id)
+	if r.order.Len() > r.size {
+		oldest := r.order.Back()
+		r.order.Remove(oldest)
+		delete(r.ids, oldest.Value.(string))
+	}
+}
+
+// Most recent insert IDs written, with -dedupe-window. The lock on the
+// messages slice must be held.
+var dedupeRecent *recentIDs
+
+// dropRecentDuplicates from the messages about to be flushed, those whose
+// insert ID is among the recent ones written, in the dedupe filter, or earlier
+// in the same flush. The filter is checked again as the message may have been
+// buffered along with one delivered earlier and written since. Messages
+// without an insert ID are always kept. The lock on the messages slice must
+// be held.
+func dropRecentDuplicates(msgs []messages.ParsedMessage) []messages.ParsedMessage {
+	if dedupeRecent == nil && dedupeCurrent == nil {
+		return msgs
+	}
+
+	seen := make(map[string]bool)
+	kept := msgs[:0]
+	for _, pm := range msgs {
+		if pm.InsertID != "" {
+			if (dedupeRecent != nil && dedupeRecent.has(pm.InsertID)) || seenBefore(&pm) || seen[pm.InsertID] {
+				metricDuplicates.Inc()
+				summaryDropped.Add(1)
+				skippedDuplicate.Add(1)
+				logger.Debug("dropped message already written", "insert_id", pm.InsertID)
+				continue
+			}
+			seen[pm.InsertID] = true
+		}
+		kept = append(kept, pm)
+	}
+	return kept
+}
+
+// noteWritten insert IDs of the messages, so that they are dropped if they
+// are delivered again. The lock on the messages slice must be held.
+func noteWritten(msgs []messages.ParsedMessage) {
+	if dedupeRecent != nil {
+		for i := range msgs {
+			if msgs[i].InsertID != "" {
+				dedupeRecent.add(msgs[i].InsertID)
+			}
+		}
+	}
+
+	if dedupeCurrent == nil {
+		return
+	}
+
+	for i := range msgs {
+		if msgs[i].InsertID == "" {
+			continue
+		}
+		if dedupeCurrent.n >= *flagDedupeBloomCapacity {
+			dedupePrevious = dedupeCurrent
+			dedupeCurrent = newBloomFilter(*flagDedupeBloomCapacity, *flagDedupeBloomFPRate)
+		}
+		dedupeCurrent.add(msgs[i].InsertID)
+		dedupeDirty = true
+	}
+}
+
+// watchDedupe filters, persisting them every d if they changed
+func watchDedupe(d time.Duration) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		buffer.mx.Lock()
+		persistDedupe()
+		buffer.mx.Unlock()
+	}
+}
+
+// persistDedupe filters to -dedupe-bloom-path, if they changed since they
+// were last persisted. The lock on the messages slice must be held.
+func persistDedupe() {
+	if dedupeCurrent == nil || !dedupeDirty {
+		return
+	}
+
+	tmp := *flagDedupeBloomPath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		logger.Error("could not persist dedupe filter", "error", err)
+		return
+	}
+
+	w := bufio.NewWriter(f)
+	_, err = w.WriteString(bloomMagic)
+	if err == nil {
+		err = dedupeCurrent.writeTo(w)
+	}
+	if err == nil && dedupePrevious != nil {
+		err = dedupePrevious.writeTo(w)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, *flagDedupeBloomPath)
+	}
+	if err != nil {
+		logger.Error("could not persist dedupe filter", "error", err)
+		return
+	}
+
+	dedupeDirty = false
+}
+
+// closeDedupe filters, persisting them a last time
+func closeDedupe() {
+	buffer.mx.Lock()
+	defer buffer.mx.Unlock()
+
+	persistDedupe()
+}
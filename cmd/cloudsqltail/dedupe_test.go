@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cloudsqltail/messages"
+)
+
+// useDedupeFilter for a test, with a small empty filter
+func useDedupeFilter(t *testing.T) {
+	t.Helper()
+	setFlag(t, "dedupe-bloom-capacity", "1000")
+	dedupeCurrent = newBloomFilter(1000, 0.001)
+	t.Cleanup(func() { dedupeCurrent, dedupePrevious = nil, nil })
+}
+
+func TestReadBloomFilterRejectsOtherSizes(t *testing.T) {
+	want := newBloomFilter(1000, 0.001)
+
+	var buf bytes.Buffer
+	if err := want.writeTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readBloomFilter(bytes.NewReader(buf.Bytes()), want); err != nil {
+		t.Fatalf("could not read back the filter: %s", err)
+	}
+
+	// A corrupt word count is rejected before anything is allocated for it
+	var corrupt bytes.Buffer
+	for _, v := range []uint64{want.k, 0, math.MaxInt32} {
+		_ = binary.Write(&corrupt, binary.BigEndian, v)
+	}
+	if _, err := readBloomFilter(&corrupt, want); !errors.Is(err, errBloomSize) {
+		t.Fatalf("got %v, want %v", err, errBloomSize)
+	}
+}
+
+func TestDuplicatesWithinOneFlushAreDropped(t *testing.T) {
+	useDedupeFilter(t)
+
+	msgs := dropRecentDuplicates([]messages.ParsedMessage{
+		{InsertID: "a", TextPayload: "first"},
+		{InsertID: "a", TextPayload: "again"},
+		{TextPayload: "no insert ID"},
+		{TextPayload: "no insert ID"},
+	})
+	if len(msgs) != 3 || msgs[0].TextPayload != "first" {
+		t.Fatalf("got %v, want the first delivery and both messages without an insert ID", msgs)
+	}
+
+	// Once written, a message buffered along with it is dropped when flushed
+	noteWritten(msgs)
+	if msgs := dropRecentDuplicates([]messages.ParsedMessage{{InsertID: "a"}}); len(msgs) != 0 {
+		t.Fatalf("got %v, want the message already written dropped", msgs)
+	}
+}
+
+func TestReplayWALSkipsWrittenMessages(t *testing.T) {
+	buf, _ := newTestBuffer(t)
+	useDedupeFilter(t)
+
+	path := filepath.Join(t.TempDir(), "wal")
+	setFlag(t, "wal-path", path)
+	data := `{"insertId":"written","textPayload":"written before the crash"}
+{"insertId":"pending","textPayload":"still buffered"}
+{"insertId":"pending","textPayload":"still buffered"}
+`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dedupeCurrent.add("written")
+
+	if err := replayWAL(buf); err != nil {
+		t.Fatal(err)
+	}
+	if len(buf.msgs) != 1 || buf.msgs[0].InsertID != "pending" {
+		t.Fatalf("replayed %v, want only the pending message", buf.msgs)
+	}
+}
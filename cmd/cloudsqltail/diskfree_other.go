@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// freeBytes cannot be told on this platform
+func freeBytes(path string) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	monitoring "google.golang.org/api/monitoring/v3"
+)
+
+// How often the backlog is checked with -adaptive-drain, matching the
+// sampling period of the backlog metric
+const backlogCheckInterval = time.Minute
+
+// drainRoutines is the number of receive goroutines to use while draining a
+// backlog with -adaptive-drain, at most maxReceiveGoroutines
+func drainRoutines() int {
+	routines := 4 * *flagReceiveGoroutines
+	if *flagAdaptiveDrainRoutines > 0 {
+		routines = *flagAdaptiveDrainRoutines
+	}
+	return min(routines, maxReceiveGoroutines)
+}
+
+// subscriptionBacklog is the number of undelivered messages in the
+// subscription, as last reported by Cloud Monitoring
+func subscriptionBacklog(ctx context.Context, svc *monitoring.Service, name string) (int64, error) {
+	now := time.Now().UTC()
+	filter := fmt.Sprintf(
+		`metric.type = "pubsub.googleapis.com/subscription/num_undelivered_messages" AND resource.labels.subscription_id = "%s"`,
+		name,
+	)
+
+	resp, err := svc.Projects.TimeSeries.List("projects/" + *flagProject).
+		Filter(filter).
+		IntervalStartTime(now.Add(-10 * time.Minute).Format(time.RFC3339)).
+		IntervalEndTime(now.Format(time.RFC3339)).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return 0, err
+	}
+
+	// Points are returned newest first
+	for _, ts := range resp.TimeSeries {
+		if len(ts.Points) > 0 && ts.Points[0].Value != nil && ts.Points[0].Value.Int64Value != nil {
+			return *ts.Points[0].Value.Int64Value, nil
+		}
+	}
+
+	return 0, errors.New("no recent backlog data point")
+}
+
+// adaptiveDrain checks the backlog of the subscription, reporting the number
+// of receive goroutines to start with and, when that is boosted, a function
+// that calls settle once the backlog has been drained below -adaptive-drain-backlog
+func adaptiveDrain(ctx context.Context, name string) (int, func(ctx context.Context, settle func())) {
+	svc, err := monitoring.NewService(ctx, credentialOptions()...)
+	if err != nil {
+		logger.Warn("could not create the Cloud Monitoring client, not adapting to the backlog", "error", err)
+		return *flagReceiveGoroutines, nil
+	}
+
+	backlog, err := subscriptionBacklog(ctx, svc, name)
+	if err != nil {
+		logger.Warn("could not read the subscription backlog, not adapting to it", "subscription", name, "error", err)
+		return *flagReceiveGoroutines, nil
+	}
+	if backlog < *flagAdaptiveDrainBacklog {
+		logger.Info("subscription backlog is small, not boosting receive", "subscription", name, "backlog", backlog)
+		return *flagReceiveGoroutines, nil
+	}
+
+	routines := drainRoutines()
+	logger.Info("draining the subscription backlog", "subscription", name, "backlog", backlog, "recv_routines", routines)
+
+	return routines, func(ctx context.Context, settle func()) {
+		ticker := time.NewTicker(backlogCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			backlog, err := subscriptionBacklog(ctx, svc, name)
+			if err != nil {
+				logger.Warn("could not read the subscription backlog", "subscription", name, "error", err)
+				continue
+			}
+
+			if backlog < *flagAdaptiveDrainBacklog {
+				logger.Info("subscription backlog drained, settling receive", "subscription", name, "backlog", backlog, "recv_routines", *flagReceiveGoroutines)
+				settle()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// parseEmbeddedJSON payload into the fields of the JSON object it holds, in
+// their order, keeping their values as is. To avoid false positives, the
+// whole payload must be a single non-empty JSON object. Reports false if it
+// is not.
+func parseEmbeddedJSON(payload string) ([]field, bool) {
+	trimmed := strings.TrimSpace(payload)
+	if len(trimmed) < 2 || trimmed[0] != '{' || trimmed[len(trimmed)-1] != '}' {
+		return nil, false
+	}
+
+	dec := json.NewDecoder(strings.NewReader(trimmed))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, false
+	}
+
+	var fields []field
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, false
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return nil, false
+		}
+
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, false
+		}
+		fields = append(fields, field{key, value})
+	}
+
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('}') {
+		return nil, false
+	}
+	if _, err := dec.Token(); err != io.EOF || len(fields) == 0 {
+		return nil, false
+	}
+
+	return fields, true
+}
+
+// Fields of the events that those of an embedded JSON object cannot replace
+var reservedFields = map[string]bool{"timestamp": true, "late": true}
+
+// withoutReserved fields, leaving out those named like one of the reserved ones
+// or like one the event already has
+func withoutReserved(fields []field, e event) []field {
+	kept := fields[:0]
+	for _, f := range fields {
+		if !reservedFields[f.key] && !e.has(f.key) {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// has a field with the given key
+func (e event) has(key string) bool {
+	for i := range e {
+		if e[i].key == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// TestPubSubEmulator receives a few log entries published out of order to a
+// subscription of the Pub/Sub emulator at $PUBSUB_EMULATOR_HOST, and flushes
+// them in order. It is skipped without an emulator, which can be started with
+// "gcloud beta emulators pubsub start".
+func TestPubSubEmulator(t *testing.T) {
+	host := os.Getenv("PUBSUB_EMULATOR_HOST")
+	if host == "" {
+		t.Skip("PUBSUB_EMULATOR_HOST is not set")
+	}
+
+	const project = "cloudsqltail-test"
+	name := fmt.Sprintf("cloudsqltail-%d", time.Now().UnixNano())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Set up a topic and subscription of our own in the emulator
+	c, err := pubsub.NewClient(ctx, project)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	topic, err := c.CreateTopic(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer topic.Delete(context.Background())
+	defer topic.Stop()
+	sub, err := c.CreateSubscription(ctx, name, pubsub.SubscriptionConfig{Topic: topic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Delete(context.Background())
+
+	entries := []string{
+		`{"insertId":"2","timestamp":"2021-06-01T10:00:02Z","textPayload":"[1]: LOG:  second"}`,
+		`{"insertId":"3","timestamp":"2021-06-01T10:00:03Z","textPayload":"[1]: LOG:  third"}`,
+		`{"insertId":"1","timestamp":"2021-06-01T10:00:01Z","textPayload":"[1]: LOG:  first"}`,
+	}
+	for _, e := range entries {
+		if _, err := topic.Publish(ctx, &pubsub.Message{Data: []byte(e)}).Get(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf, out := newTestBuffer(t)
+	buffer = buf
+	t.Cleanup(func() { buffer = nil })
+	setFlag(t, "emulator-host", host)
+	setFlag(t, "project", project)
+	setFlag(t, "subscription", name)
+	captureLogs(t)
+
+	// Receive until every entry is buffered
+	recvCtx, stop := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- receivePubSub(recvCtx) }()
+	for buf.Len() < len(entries) && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+	if err := <-done; exitCode(recvCtx, err) != 0 {
+		t.Fatalf("receiving failed: %s", err)
+	}
+
+	buf.Flush(true)
+	want := "[2021-06-01 10:00:01 UTC]: [1]: LOG:  first\n" +
+		"[2021-06-01 10:00:02 UTC]: [1]: LOG:  second\n" +
+		"[2021-06-01 10:00:03 UTC]: [1]: LOG:  third\n"
+	if got := out.String(); got != want {
+		t.Errorf("flushed\n%q\nwant\n%q", got, want)
+	}
+}
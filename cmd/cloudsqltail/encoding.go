@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+
+	"cloudsqltail/messages"
+)
+
+// Character encodings supported by -input-encoding
+const (
+	inputEncodingUTF8        = "utf8"
+	inputEncodingLatin1      = "latin1"
+	inputEncodingWindows1252 = "windows-1252"
+)
+
+// Encoding of the received messages to transcode to UTF-8, parsed from
+// -input-encoding, or nil when they already are UTF-8
+var inputEncoding encoding.Encoding
+
+// parseInputEncoding given by -input-encoding
+func parseInputEncoding(name string) (encoding.Encoding, bool) {
+	switch name {
+	case inputEncodingUTF8:
+		return nil, true
+	case inputEncodingLatin1:
+		return charmap.ISO8859_1, true
+	case inputEncodingWindows1252:
+		return charmap.Windows1252, true
+	default:
+		return nil, false
+	}
+}
+
+// transcode raw data to UTF-8 from the input encoding
+func transcode(data []byte) []byte {
+	if inputEncoding == nil {
+		return data
+	}
+
+	utf8, err := inputEncoding.NewDecoder().Bytes(data)
+	if err != nil {
+		logger.Debug("could not transcode message to UTF-8", "error", err)
+		return data
+	}
+	return utf8
+}
+
+// transcodePayload of a parsed message to UTF-8 from the input encoding. Only
+// the textPayload was logged by the database, the rest of the entry is UTF-8
+// from Cloud Logging, so only its string is transcoded, from the raw data as
+// parsing replaced the bytes that are not valid UTF-8.
+func transcodePayload(data []byte, pm *messages.ParsedMessage) {
+	if inputEncoding == nil {
+		return
+	}
+
+	var raw struct {
+		TextPayload json.RawMessage `json:"textPayload"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil || len(raw.TextPayload) == 0 {
+		return
+	}
+
+	// The JSON syntax of the string is ASCII, which all supported encodings
+	// share
+	var payload string
+	if err := json.Unmarshal(transcode(raw.TextPayload), &payload); err != nil {
+		logger.Debug("could not transcode message to UTF-8", "error", err)
+		return
+	}
+	pm.TextPayload = payload
+}
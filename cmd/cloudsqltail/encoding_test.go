@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTranscodeOnlyTextPayload(t *testing.T) {
+	tests := []struct {
+		encoding string
+		payload  string
+		want     string
+	}{
+		// "é" is 0xe9 in both, "€" is 0x80 in Windows-1252 only
+		{encoding: inputEncodingLatin1, payload: "[1]: caf\xe9 \xa35", want: "[1]: café £5"},
+		{encoding: inputEncodingWindows1252, payload: "[1]: caf\xe9 \x805", want: "[1]: café €5"},
+		{encoding: inputEncodingUTF8, payload: "[1]: café", want: "[1]: café"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.encoding, func(t *testing.T) {
+			buf, _ := newTestBuffer(t)
+			enc, _ := parseInputEncoding(tt.encoding)
+			inputEncoding = enc
+			t.Cleanup(func() { inputEncoding = nil })
+
+			// The labels are UTF-8 from Cloud Logging, whatever the database logs in
+			data := `{"textPayload":"` + tt.payload + `","labels":{"user":"josé"},"resource":{"labels":{"database_id":"prod:café"}}}`
+			buf.Add([]byte(data), "", "", "")
+			if len(buf.msgs) != 1 {
+				t.Fatalf("buffered %d messages, want 1", len(buf.msgs))
+			}
+
+			pm := buf.msgs[0]
+			if pm.TextPayload != tt.want {
+				t.Errorf("got payload %q, want %q", pm.TextPayload, tt.want)
+			}
+			if pm.Labels["user"] != "josé" {
+				t.Errorf("got label %q, want it left as UTF-8", pm.Labels["user"])
+			}
+			if got := pm.Resource.Labels["database_id"]; got != "prod:café" {
+				t.Errorf("got database ID %q, want it left as UTF-8", got)
+			}
+		})
+	}
+}
+
+func TestTranscodeRawMessage(t *testing.T) {
+	buf, _ := newTestBuffer(t)
+	setFlag(t, "emit-raw-on-error", "true")
+	captureLogs(t)
+	inputEncoding, _ = parseInputEncoding(inputEncodingLatin1)
+	t.Cleanup(func() { inputEncoding = nil })
+
+	buf.Add([]byte("not JSON: caf\xe9"), "", "", "")
+	if len(buf.msgs) != 1 || buf.msgs[0].TextPayload != rawPayloadPrefix+"not JSON: café" {
+		t.Fatalf("buffered %v, want the raw message transcoded", buf.msgs)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stages of the pipeline that errors are reported from
+const (
+	stageSize   = "size"
+	stageSchema = "schema"
+	stageParse  = "parse"
+	stageOutput = "output"
+)
+
+var (
+	// File that structured error records are appended to, if configured
+	errorOutputFile *os.File
+
+	// Mutex used to protect the error output file
+	errorOutputMx sync.Mutex
+)
+
+// errorRecord written to the error output for each error
+type errorRecord struct {
+	Time      time.Time `json:"time"`
+	Stage     string    `json:"stage"`
+	MessageID string    `json:"message_id,omitempty"`
+	Error     string    `json:"error"`
+}
+
+// openErrorOutput file given by -error-output for appending, if one is set
+func openErrorOutput() error {
+	if *flagErrorOutput == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(*flagErrorOutput, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	errorOutputFile = f
+	return nil
+}
+
+// reportError at the given stage, about the message with the given ID if
+// there is one, by appending it as a JSON record to the error output. This is
+// a no-op if no error output is configured.
+func reportError(stage, messageID string, err error) {
+	errorOutputMx.Lock()
+	defer errorOutputMx.Unlock()
+
+	if errorOutputFile == nil {
+		return
+	}
+
+	line, mErr := json.Marshal(errorRecord{
+		Time:      time.Now().UTC(),
+		Stage:     stage,
+		MessageID: messageID,
+		Error:     err.Error(),
+	})
+	if mErr != nil {
+		logger.Error("could not encode error record", "error", mErr)
+		return
+	}
+
+	if _, wErr := errorOutputFile.Write(append(line, '\n')); wErr != nil {
+		logger.Error("could not write to error output", "error", wErr)
+	}
+}
+
+// closeErrorOutput file, if one is open
+func closeErrorOutput() {
+	errorOutputMx.Lock()
+	defer errorOutputMx.Unlock()
+
+	if errorOutputFile == nil {
+		return
+	}
+
+	if err := errorOutputFile.Close(); err != nil {
+		logger.Error("could not close error output", "error", err)
+	}
+	errorOutputFile = nil
+}
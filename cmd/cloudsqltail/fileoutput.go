@@ -0,0 +1,238 @@
+package main
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// Layout of the time a file was started at, inserted into the file names
+const fileTimeLayout = "20060102T150405Z"
+
+// parquetRow is the schema of the Parquet output format
+type parquetRow struct {
+	Timestamp  int64  `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MICROS"`
+	Severity   string `parquet:"name=severity, type=BYTE_ARRAY, convertedtype=UTF8"`
+	DatabaseID string `parquet:"name=database_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Message    string `parquet:"name=message, type=BYTE_ARRAY, convertedtype=UTF8"`
+}
+
+// fileWriter writes to a file, rolled over to a new one at the start of every
+// -output-file-window. Rolled files, Parquet files which cannot be appended to
+// and atomically written files have the time they were started at in their
+// name.
+type fileWriter struct {
+	path   string
+	window time.Duration
+
+	// Set to write each file under a temporary name, renamed once complete
+	atomic bool
+
+	// Set to truncate an existing file instead of appending to it
+	truncate bool
+
+	// Set to compress each write as a gzip member of its own, so that the
+	// file can be read up to the last flush, even while more is appended
+	gzip bool
+	zw   *gzip.Writer
+
+	f     *os.File
+	name  string
+	start time.Time
+
+	// Writer of the current file with the Parquet output format
+	rows *writer.ParquetWriter
+}
+
+// Set while the free space on the disk of the file output is below
+// -min-free-bytes, holding the buffer back
+var diskLow atomic.Bool
+
+// freeSpace on the file system holding a path, replaced in tests
+var freeSpace = freeBytes
+
+// Write p to the current file
+func (fw *fileWriter) Write(p []byte) (int, error) {
+	if err := fw.roll(); err != nil {
+		return 0, err
+	}
+
+	if !fw.gzip {
+		return fw.f.Write(p)
+	}
+
+	if fw.zw == nil {
+		fw.zw = gzip.NewWriter(fw.f)
+	} else {
+		fw.zw.Reset(fw.f)
+	}
+	if _, err := fw.zw.Write(p); err != nil {
+		return 0, err
+	}
+	if err := fw.zw.Close(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeRows of the messages of the batch that have a payload to the current
+// Parquet file, as one row group
+func (fw *fileWriter) writeRows(b batch) error {
+	if len(b.msgs) == 0 {
+		return nil
+	}
+	if err := fw.roll(); err != nil {
+		return err
+	}
+
+	for i := range b.msgs {
+		msg := &b.msgs[i]
+		if msg.TextPayload == "" {
+			continue
+		}
+
+		err := fw.rows.Write(parquetRow{
+			Timestamp:  msg.Timestamp.UnixMicro(),
+			Severity:   msg.Severity,
+			DatabaseID: msg.DatabaseID(),
+			Message:    msg.TextPayload,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return fw.rows.Flush(true)
+}
+
+// lowOnSpace reports whether the free space on the disk of the file output is
+// below -min-free-bytes, in which case writes are held back rather than
+// filling the disk up
+func (fw *fileWriter) lowOnSpace() bool {
+	if *flagMinFreeBytes <= 0 {
+		return false
+	}
+
+	free, ok := freeSpace(filepath.Dir(fw.path))
+	if !ok {
+		return false
+	}
+
+	if free < *flagMinFreeBytes {
+		if diskLow.CompareAndSwap(false, true) {
+			logger.Warn("free disk space below the minimum, holding writes back", "free_bytes", free, "min_free_bytes", *flagMinFreeBytes)
+		}
+		return true
+	}
+
+	if diskLow.CompareAndSwap(true, false) {
+		logger.Info("free disk space back above the minimum", "free_bytes", free)
+	}
+	return false
+}
+
+// roll over to a new file if there is none yet or the window is over
+func (fw *fileWriter) roll() error {
+	now := time.Now().UTC()
+	if fw.f != nil && (fw.window <= 0 || now.Before(fw.start.Add(fw.window))) {
+		return nil
+	}
+
+	if err := fw.Close(); err != nil {
+		return err
+	}
+
+	previous := fw.start
+	fw.start = now
+	if fw.window > 0 {
+		fw.start = now.Truncate(fw.window)
+	}
+
+	parquet := *flagOutputFormat == outputFormatParquet
+	overwrite := parquet || fw.atomic || fw.truncate
+	fw.name = fw.path
+	if fw.window > 0 || parquet || fw.atomic {
+		fw.name = fw.startedName(previous, overwrite)
+	}
+
+	path, mode := fw.name, os.O_CREATE|os.O_APPEND|os.O_WRONLY
+	if overwrite {
+		mode = os.O_CREATE | os.O_TRUNC | os.O_WRONLY
+	}
+	if fw.atomic {
+		path += ".tmp"
+	}
+	f, err := os.OpenFile(path, mode, 0644)
+	if err != nil {
+		return err
+	}
+	fw.f = f
+
+	if parquet {
+		rows, err := writer.NewParquetWriterFromWriter(f, new(parquetRow), 1)
+		if err != nil {
+			return err
+		}
+		fw.rows = rows
+	}
+
+	return nil
+}
+
+// startedName of the file started at fw.start, numbered when the time in the
+// name is that of the previous file, which happens with windows under a
+// second, or when it would overwrite an existing file, for example one
+// written before a restart within the same window. Numbered names are never
+// those of an existing file.
+func (fw *fileWriter) startedName(previous time.Time, overwrite bool) string {
+	ext := filepath.Ext(fw.path)
+	base := strings.TrimSuffix(fw.path, ext) + "-" + fw.start.Format(fileTimeLayout)
+
+	sameSecond := !previous.IsZero() && previous.Format(fileTimeLayout) == fw.start.Format(fileTimeLayout)
+	if name := base + ext; !sameSecond && !(overwrite && exists(name)) {
+		return name
+	}
+	for i := 1; ; i++ {
+		if name := base + "-" + strconv.Itoa(i) + ext; !exists(name) {
+			return name
+		}
+	}
+}
+
+// exists reports whether there is a file at the path
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Close the current file, writing the footer of a Parquet file and giving
+// an atomically written file its final name
+func (fw *fileWriter) Close() error {
+	if fw.f == nil {
+		return nil
+	}
+
+	if fw.rows != nil {
+		if err := fw.rows.WriteStop(); err != nil {
+			return err
+		}
+		fw.rows = nil
+	}
+
+	f := fw.f
+	fw.f = nil
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if fw.atomic {
+		return os.Rename(f.Name(), fw.name)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubFreeSpace on the disk of the file output for a test, reporting the
+// bytes free variable
+func stubFreeSpace(t *testing.T, free *int64) {
+	t.Helper()
+	freeSpace = func(string) (int64, bool) { return *free, true }
+	t.Cleanup(func() {
+		freeSpace = freeBytes
+		diskLow.Store(false)
+	})
+}
+
+func TestLowDiskHoldsFlushesBack(t *testing.T) {
+	free := int64(10)
+	stubFreeSpace(t, &free)
+	setFlag(t, "min-free-bytes", "1000")
+	setFlag(t, "on-output-error", outputErrorExit)
+	setFlag(t, "liveness-flush-timeout", "1ns")
+	captureLogs(t)
+
+	path := filepath.Join(t.TempDir(), "logs.log")
+	fw := &fileWriter{path: path}
+	t.Cleanup(func() { _ = fw.Close() })
+	buf, _ := newTestBuffer(t)
+	buf.out = fw
+	for _, pm := range testBatch(3).msgs {
+		buf.insert(pm)
+	}
+	received := summaryReceived.Swap(3)
+	t.Cleanup(func() { summaryReceived.Store(received) })
+
+	// Held back rather than failing the write, which would exit
+	buf.Flush(false)
+	if buf.Len() != 3 {
+		t.Fatalf("%d messages left in the buffer, want all 3 kept", buf.Len())
+	}
+	if !diskLow.Load() {
+		t.Fatal("disk not reported low")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("output file written while the disk is low: %v", err)
+	}
+	buf.mx.Lock()
+	full := buf.full(0)
+	buf.mx.Unlock()
+	if !full {
+		t.Error("buffer has room for more messages while the disk is low")
+	}
+	if wedged() {
+		t.Error("held back flushes reported as wedged")
+	}
+
+	// Written on the next flush once there is space again
+	free = 1000
+	buf.Flush(false)
+	if buf.Len() != 0 || diskLow.Load() {
+		t.Fatalf("%d messages left in the buffer and disk low %t, want all written", buf.Len(), diskLow.Load())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(data), "\n"); got != 3 {
+		t.Errorf("wrote %d lines, want 3: %q", got, data)
+	}
+}
+
+func TestLowDiskStillDrains(t *testing.T) {
+	free := int64(10)
+	stubFreeSpace(t, &free)
+	setFlag(t, "min-free-bytes", "1000")
+	captureLogs(t)
+
+	fw := &fileWriter{path: filepath.Join(t.TempDir(), "logs.log")}
+	t.Cleanup(func() { _ = fw.Close() })
+	buf, _ := newTestBuffer(t)
+	buf.out = fw
+	for _, pm := range testBatch(2).msgs {
+		buf.insert(pm)
+	}
+
+	// There is no later flush to hold the messages back for
+	buf.Flush(true)
+	if buf.Len() != 0 {
+		t.Fatalf("%d messages left in the buffer, want all written when draining", buf.Len())
+	}
+}
+
+func TestStartedName(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	started := filepath.Join(dir, "logs-20210601T100000Z.ndjson")
+	if err := os.WriteFile(started, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		started   time.Duration
+		previous  time.Time
+		overwrite bool
+		existing  []string
+		want      string
+	}{
+		{name: "appended to", want: started},
+		{name: "appended to after an earlier window", previous: start.Add(-time.Hour), want: started},
+		{name: "overwritten", overwrite: true, want: "logs-20210601T100000Z-1.ndjson"},
+		{name: "previous window in the same second", started: 500 * time.Millisecond, previous: start, want: "logs-20210601T100000Z-1.ndjson"},
+		{name: "numbered files taken", started: 500 * time.Millisecond, previous: start, existing: []string{"logs-20210601T100000Z-1.ndjson"}, want: "logs-20210601T100000Z-2.ndjson"},
+		{name: "free", started: time.Hour, previous: start, overwrite: true, want: "logs-20210601T110000Z.ndjson"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range tt.existing {
+				path := filepath.Join(dir, name)
+				if err := os.WriteFile(path, nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { _ = os.Remove(path) })
+			}
+
+			fw := &fileWriter{path: filepath.Join(dir, "logs.ndjson"), start: start.Add(tt.started)}
+			if got := fw.startedName(tt.previous, tt.overwrite); filepath.Base(got) != filepath.Base(tt.want) {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRollWithinASecond(t *testing.T) {
+	dir := t.TempDir()
+	fw := &fileWriter{path: filepath.Join(dir, "logs.log"), window: time.Millisecond}
+	t.Cleanup(func() { _ = fw.Close() })
+
+	for i := 0; i < 3; i++ {
+		if _, err := fw.Write([]byte("line\n")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each window has a file of its own, named after its start
+	files, err := filepath.Glob(filepath.Join(dir, "logs-*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("got files %v, want 3", files)
+	}
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "line\n" {
+			t.Errorf("got %q in %s, want one line", data, path)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// stringsFlag is a repeatable flag collecting every value it is given
+type stringsFlag []string
+
+// String representation of the collected values
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+// Set adds another value to the collected ones
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// Modes supported by -compact-whitespace
+const (
+	compactOff  = "false"
+	compactAll  = "true"
+	compactSafe = "safe"
+)
+
+// compactFlag is a boolean flag that also accepts the "safe" mode
+type compactFlag string
+
+// String representation of the mode
+func (f *compactFlag) String() string {
+	return string(*f)
+}
+
+// Set the mode from a boolean or "safe"
+func (f *compactFlag) Set(value string) error {
+	if value == compactSafe {
+		*f = compactSafe
+		return nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unknown whitespace compaction mode '%s'", value))
+	}
+	*f = compactFlag(strconv.FormatBool(b))
+	return nil
+}
+
+// IsBoolFlag so that the flag can be given without a value
+func (f *compactFlag) IsBoolFlag() bool {
+	return true
+}
+
+// splitList of comma separated values, ignoring empty ones
+func splitList(s string) []string {
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
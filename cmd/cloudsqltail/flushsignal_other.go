@@ -0,0 +1,6 @@
+//go:build !unix
+
+package main
+
+// watchFlushSignal does nothing, as there is no SIGUSR1 on this platform
+func watchFlushSignal() {}
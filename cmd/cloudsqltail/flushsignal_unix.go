@@ -0,0 +1,21 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchFlushSignal, flushing on each SIGUSR1 as a tick would. Flushes hold
+// the lock on the messages slice, so this never overlaps with a tick.
+func watchFlushSignal() {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+
+	for range usr1 {
+		logger.Info("flushing on SIGUSR1")
+		buffer.Flush(false)
+	}
+}
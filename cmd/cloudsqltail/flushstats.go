@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+)
+
+// Value of -flush-stats writing the statistics to the output itself
+const flushStatsInline = "output"
+
+// Where the statistics of each flush are written, if anywhere
+var flushStatsOutput io.Writer
+
+// openFlushStats output given by -flush-stats, if one is set
+func openFlushStats() error {
+	switch *flagFlushStats {
+	case "":
+	case flushStatsInline:
+		flushStatsOutput = output
+	default:
+		f, err := os.OpenFile(*flagFlushStats, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		flushStatsOutput = f
+	}
+
+	return nil
+}
+
+// writeFlushStats of a batch that was written in the given time, as an event
+// marked with "_flush_stats" so that it can be told apart from the messages.
+// The lock on the messages slice must be held.
+func writeFlushStats(b batch, d time.Duration) {
+	if flushStatsOutput == nil || len(b.msgs) == 0 {
+		return
+	}
+
+	bytes := 0
+	var oldest, newest time.Time
+	for i := range b.msgs {
+		bytes += len(b.msgs[i].TextPayload)
+
+		ts := b.msgs[i].Timestamp
+		if ts.IsZero() {
+			continue
+		}
+		if oldest.IsZero() || ts.Before(oldest) {
+			oldest = ts
+		}
+		if ts.After(newest) {
+			newest = ts
+		}
+	}
+
+	e := event{
+		{"_flush_stats", true},
+		{"timestamp", time.Now().UTC()},
+		{"count", len(b.msgs)},
+		{"bytes", bytes},
+		{"min_timestamp", oldest},
+		{"max_timestamp", newest},
+		{"duration_ms", d.Milliseconds()},
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		logger.Error("could not encode flush statistics", "error", err)
+		return
+	}
+
+	if _, err := flushStatsOutput.Write(append(data, lineEnding...)); err != nil {
+		logger.Error("could not write flush statistics", "error", err)
+	}
+}
+
+// closeFlushStats file, if one is open
+func closeFlushStats() {
+	f, ok := flushStatsOutput.(*os.File)
+	if !ok {
+		return
+	}
+
+	if err := f.Close(); err != nil {
+		logger.Error("could not close flush statistics file", "error", err)
+	}
+	flushStatsOutput = nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"time"
+
+	"google.golang.org/api/option"
+	"google.golang.org/api/storage/v1"
+)
+
+// Compressions supported by -gcs-compression
+const (
+	gcsCompressionGzip = "gzip"
+	gcsCompressionNone = "none"
+)
+
+// Timeout of writing a single object to the GCS output
+const gcsUploadTimeout = 5 * time.Minute
+
+// gcsWriter buffers everything written to it over each -gcs-window, and
+// writes it as a single object named after the time the window was started
+// to a Cloud Storage bucket once the window is over
+type gcsWriter struct {
+	svc    *storage.Service
+	bucket string
+	prefix string
+	window time.Duration
+
+	// Set to compress the objects with gzip
+	gzip bool
+
+	buf   bytes.Buffer
+	zw    *gzip.Writer
+	name  string
+	start time.Time
+
+	// Set once something was written in the current window
+	written bool
+}
+
+// newGCSWriter for the bucket configured by the -gcs-* flags
+func newGCSWriter() (*gcsWriter, error) {
+	opts := append(credentialOptions(), option.WithScopes(storage.DevstorageReadWriteScope))
+	svc, err := storage.NewService(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gcsWriter{
+		svc:    svc,
+		bucket: *flagGCSBucket,
+		prefix: *flagGCSPrefix,
+		window: *flagGCSWindow,
+		gzip:   *flagGCSCompression == gcsCompressionGzip,
+	}, nil
+}
+
+// Write p to the object of the current window
+func (gw *gcsWriter) Write(p []byte) (int, error) {
+	if err := gw.roll(); err != nil {
+		return 0, err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	gw.written = true
+	if gw.zw != nil {
+		return gw.zw.Write(p)
+	}
+	return gw.buf.Write(p)
+}
+
+// roll over to a new object if there is none yet or the window is over,
+// writing out the previous one
+func (gw *gcsWriter) roll() error {
+	now := time.Now().UTC()
+	if !gw.start.IsZero() && now.Before(gw.start.Add(gw.window)) {
+		return nil
+	}
+
+	if err := gw.Close(); err != nil {
+		return err
+	}
+
+	gw.start = now.Truncate(gw.window)
+	gw.name = gw.prefix + now.Format(fileTimeLayout) + outputExtension()
+	gw.buf.Reset()
+	gw.zw = nil
+	if gw.gzip {
+		gw.name += ".gz"
+		gw.zw = gzip.NewWriter(&gw.buf)
+	}
+
+	return nil
+}
+
+// Close the object of the current window, writing it to the bucket unless
+// nothing was written to it. If writing it fails, it is kept to be written by
+// the next call.
+func (gw *gcsWriter) Close() error {
+	if !gw.written {
+		return nil
+	}
+
+	if gw.zw != nil {
+		if err := gw.zw.Close(); err != nil {
+			return err
+		}
+	}
+
+	obj := &storage.Object{Name: gw.name, ContentType: contentType()}
+	if gw.gzip {
+		obj.ContentEncoding = "gzip"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gcsUploadTimeout)
+	defer cancel()
+	_, err := gw.svc.Objects.Insert(gw.bucket, obj).Media(bytes.NewReader(gw.buf.Bytes())).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+
+	logger.Debug("wrote output object", "bucket", gw.bucket, "name", gw.name, "bytes", gw.buf.Len())
+	gw.written = false
+	gw.buf.Reset()
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"runtime"
+	"time"
+)
+
+// watchGoroutines every d, logging how many there are and warning when they
+// grow past -goroutine-watch-factor times the number at the first check.
+// Only new highs are warned about, so that a steady leak repeats the warning
+// without a stable count flooding the logs.
+func watchGoroutines(d time.Duration) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+
+	var baseline, high int
+	for range ticker.C {
+		n := runtime.NumGoroutine()
+		if baseline == 0 {
+			baseline, high = n, n
+		}
+
+		limit := int(float64(baseline) * *flagGoroutineWatchFactor)
+		if n > limit && n > high {
+			logger.Warn("goroutines grew past the baseline, they may be leaking", "goroutines", n, "baseline", baseline, "limit", limit)
+		} else {
+			logger.Info("goroutines", "goroutines", n, "baseline", baseline)
+		}
+		if n > high {
+			high = n
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// honeycombEvent in the format of the Honeycomb batch API
+type honeycombEvent struct {
+	Time time.Time `json:"time"`
+	Data event     `json:"data"`
+}
+
+// honeycombWriter sends the events of each flush straight to a Honeycomb
+// dataset, through its batch API, instead of writing them for honeytail
+type honeycombWriter struct {
+	client   *http.Client
+	url      string
+	writeKey string
+
+	// Limits of a single request, as with the HTTP output
+	batchSize  int
+	batchBytes int
+	retries    int
+}
+
+// newHoneycombWriter for the dataset configured by the -honeycomb-* flags,
+// with the request limits of the -http-* ones
+func newHoneycombWriter() *honeycombWriter {
+	return &honeycombWriter{
+		client:     &http.Client{Timeout: httpOutputTimeout},
+		url:        strings.TrimSuffix(*flagHoneycombAPIHost, "/") + "/1/batch/" + url.PathEscape(*flagHoneycombDataset),
+		writeKey:   *flagHoneycombWriteKey,
+		batchSize:  *flagHTTPBatchSize,
+		batchBytes: *flagHTTPBatchBytes,
+		retries:    *flagHTTPRetries,
+	}
+}
+
+// Write is not supported, as events are sent whole by writeBatch
+func (hw *honeycombWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("the Honeycomb output only sends events")
+}
+
+// writeBatch of messages as events, in requests of at most -http-batch-size
+// messages each. If one fails, the error reports how many messages the
+// requests before it wrote.
+func (hw *honeycombWriter) writeBatch(b batch) error {
+	size := hw.batchSize
+	if size <= 0 || size > len(b.msgs) {
+		size = len(b.msgs)
+	}
+
+	for i := 0; i < len(b.msgs); i += size {
+		if err := hw.writeChunk(b.slice(i, min(i+size, len(b.msgs)))); err != nil {
+			return afterWritten(i, err)
+		}
+	}
+
+	return nil
+}
+
+// writeChunk of the batch as a single request, unless its body would be over
+// -http-batch-bytes, in which case it is split in halves. A single message
+// over the limit is still sent on its own.
+func (hw *honeycombWriter) writeChunk(b batch) error {
+	events := events(b)
+	if len(events) == 0 {
+		return nil
+	}
+
+	batch := make([]honeycombEvent, len(events))
+	for i, e := range events {
+		// The timestamp is always the first field, and is the time of the event
+		t, _ := e[0].value.(time.Time)
+		batch[i] = honeycombEvent{Time: t, Data: e[1:]}
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	if hw.batchBytes > 0 && len(body) > hw.batchBytes && len(b.msgs) > 1 {
+		half := len(b.msgs) / 2
+		if err := hw.writeChunk(b.slice(0, half)); err != nil {
+			return err
+		}
+		return afterWritten(half, hw.writeChunk(b.slice(half, len(b.msgs))))
+	}
+
+	return hw.sendWithRetries(body)
+}
+
+// sendWithRetries the body as one request, retrying with a backoff
+func (hw *honeycombWriter) sendWithRetries(body []byte) error {
+	var err error
+	for attempt := 0; attempt <= hw.retries; attempt++ {
+		if attempt > 0 {
+			logger.Warn("retrying Honeycomb request", "attempt", attempt, "error", err)
+			time.Sleep(retryBackoff(attempt))
+		}
+
+		if err = hw.send(body); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// send a single request to the batch API, warning about the events it did
+// not accept
+func (hw *honeycombWriter) send(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, hw.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Honeycomb-Team", hw.writeKey)
+
+	resp, err := hw.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return errors.New(fmt.Sprintf("Honeycomb request failed with status '%s'", resp.Status))
+	}
+
+	// Each event is accepted or not on its own
+	var statuses []struct {
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+		return nil
+	}
+	rejected, reason := 0, ""
+	for _, s := range statuses {
+		if s.Status < 200 || s.Status > 299 {
+			rejected++
+			reason = s.Error
+		}
+	}
+	if rejected > 0 {
+		logger.Warn("Honeycomb rejected events", "rejected", rejected, "error", reason)
+	}
+
+	return nil
+}
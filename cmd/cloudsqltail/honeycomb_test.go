@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// events in each batch the endpoint received, in order
+func (e *testEndpoint) events(t *testing.T) []int {
+	t.Helper()
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	var events []int
+	for _, body := range e.bodies {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(body, &batch); err != nil {
+			t.Fatalf("could not decode batch: %s", err)
+		}
+		events = append(events, len(batch))
+	}
+	return events
+}
+
+// newTestHoneycombWriter to the endpoint, with requests of at most size
+// messages and no retries
+func newTestHoneycombWriter(srv *httptest.Server, size int) *honeycombWriter {
+	return &honeycombWriter{client: srv.Client(), url: srv.URL, batchSize: size}
+}
+
+func TestHoneycombWriteBatchBoundaries(t *testing.T) {
+	const n = 3
+	tests := []struct {
+		messages int
+		want     []int
+	}{
+		{messages: 0, want: nil},
+		{messages: n - 1, want: []int{n - 1}},
+		{messages: n, want: []int{n}},
+		{messages: n + 1, want: []int{n, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.messages), func(t *testing.T) {
+			endpoint, srv := newTestEndpoint(t)
+			hw := newTestHoneycombWriter(srv, n)
+
+			if err := hw.writeBatch(testBatch(tt.messages)); err != nil {
+				t.Fatal(err)
+			}
+			if got := endpoint.events(t); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("sent batches of %v events, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHoneycombWriteBatchSplitsByBytes(t *testing.T) {
+	endpoint, srv := newTestEndpoint(t)
+	hw := newTestHoneycombWriter(srv, 0)
+
+	// Two events fit in the limit, and one over it is still sent on its own,
+	// once the half it is in is halved again
+	body, err := json.Marshal([]honeycombEvent{{Data: events(testBatch(1))[0][1:]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hw.batchBytes = 2*len(body) + len(body)/2
+	b := testBatch(5)
+	b.msgs[4].TextPayload += strings.Repeat("x", 3*len(body))
+
+	if err := hw.writeBatch(b); err != nil {
+		t.Fatal(err)
+	}
+	if got := endpoint.events(t); fmt.Sprint(got) != "[2 1 1 1]" {
+		t.Errorf("sent batches of %v events, want [2 1 1 1]", got)
+	}
+}
+
+func TestHoneycombWriteBatchReportsPartialProgress(t *testing.T) {
+	setFlag(t, "retry-backoff-base", "1ms")
+	captureLogs(t)
+
+	tests := []struct {
+		name    string
+		size    int
+		bytes   int
+		fail    []int
+		written int
+	}{
+		{name: "first request", size: 3, fail: []int{1}, written: 0},
+		{name: "later request", size: 3, fail: []int{2}, written: 3},
+		{name: "halved by bytes", bytes: 1, fail: []int{4}, written: 3},
+		{name: "every retry", size: 3, fail: []int{2, 3, 4}, written: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint, srv := newTestEndpoint(t, tt.fail...)
+			hw := newTestHoneycombWriter(srv, tt.size)
+			hw.batchBytes = tt.bytes
+			hw.retries = len(tt.fail) - 1
+
+			err := hw.writeBatch(testBatch(7))
+			if err == nil {
+				t.Fatal("write succeeded, want it to fail")
+			}
+			if got := writtenBefore(err); got != tt.written {
+				t.Errorf("got %d messages written before %q, want %d", got, err, tt.written)
+			}
+			if got := len(endpoint.bodies); got != tt.fail[len(tt.fail)-1] {
+				t.Errorf("sent %d requests, want none after the failed one", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Timeout of a single request made by the HTTP output
+const httpOutputTimeout = 30 * time.Second
+
+// httpWriter sends everything written to it in a single write, which is a
+// flush, as the body of one request to an HTTP endpoint
+type httpWriter struct {
+	client  *http.Client
+	url     string
+	method  string
+	header  http.Header
+	retries int
+}
+
+// newHTTPWriter for the endpoint configured by the -http-* flags
+func newHTTPWriter() (*httpWriter, error) {
+	header := make(http.Header)
+	header.Set("Content-Type", contentType())
+
+	for _, h := range flagHTTPHeaders {
+		k, v, ok := strings.Cut(h, "=")
+		if !ok || k == "" {
+			return nil, errors.New(fmt.Sprintf("HTTP header '%s' must be of the form key=value", h))
+		}
+		header.Set(k, v)
+	}
+
+	return &httpWriter{
+		client:  &http.Client{Timeout: httpOutputTimeout},
+		url:     *flagHTTPURL,
+		method:  *flagHTTPMethod,
+		header:  header,
+		retries: *flagHTTPRetries,
+	}, nil
+}
+
+// Write p as the body of a request, retrying with a backoff
+func (h *httpWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	var err error
+	for attempt := 0; attempt <= h.retries; attempt++ {
+		if attempt > 0 {
+			logger.Warn("retrying HTTP output request", "attempt", attempt, "error", err)
+			time.Sleep(retryBackoff(attempt))
+		}
+
+		if err = h.send(p); err == nil {
+			return len(p), nil
+		}
+	}
+
+	return 0, err
+}
+
+// send a single request with the given body
+func (h *httpWriter) send(body []byte) error {
+	req, err := http.NewRequest(h.method, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = h.header.Clone()
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(fmt.Sprintf("HTTP output request failed with status '%s'", resp.Status))
+	}
+
+	return nil
+}
+
+// writeChunks of the batch to the HTTP output, as requests of at most
+// -http-batch-size messages each. If one fails, the error reports how many
+// messages the requests before it wrote.
+func writeChunks(w io.Writer, b batch) error {
+	size := *flagHTTPBatchSize
+	if size <= 0 || size > len(b.msgs) {
+		size = len(b.msgs)
+	}
+	if size == 0 {
+		return writeChunk(w, b)
+	}
+
+	for i := 0; i < len(b.msgs); i += size {
+		if err := writeChunk(w, b.slice(i, min(i+size, len(b.msgs)))); err != nil {
+			return afterWritten(i, err)
+		}
+	}
+
+	return nil
+}
+
+// writeChunk of the batch as a single request, unless its body would be over
+// -http-batch-bytes, in which case it is split in halves. A single message
+// over the limit is still sent on its own.
+func writeChunk(w io.Writer, b batch) error {
+	buf, cont, err := formatBatch(b)
+	if err != nil {
+		return err
+	}
+
+	if *flagHTTPBatchBytes > 0 && buf.Len() > *flagHTTPBatchBytes && len(b.msgs) > 1 {
+		half := len(b.msgs) / 2
+		if err := writeChunk(w, b.slice(0, half)); err != nil {
+			return err
+		}
+		return afterWritten(half, writeChunk(w, b.slice(half, len(b.msgs))))
+	}
+
+	return writeFormatted(w, buf, cont)
+}
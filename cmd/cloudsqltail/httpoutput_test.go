@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"cloudsqltail/messages"
+)
+
+// testEndpoint records the bodies of the requests it receives, failing the
+// ones numbered in fail, counting from 1
+type testEndpoint struct {
+	mx     sync.Mutex
+	bodies [][]byte
+	fail   map[int]bool
+}
+
+// newTestEndpoint served for the duration of the test
+func newTestEndpoint(t *testing.T, fail ...int) (*testEndpoint, *httptest.Server) {
+	t.Helper()
+	e := &testEndpoint{fail: map[int]bool{}}
+	for _, n := range fail {
+		e.fail[n] = true
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		e.mx.Lock()
+		defer e.mx.Unlock()
+		e.bodies = append(e.bodies, body)
+		if e.fail[len(e.bodies)] {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("[]"))
+	}))
+	t.Cleanup(srv.Close)
+
+	return e, srv
+}
+
+// lines in each body received, in order
+func (e *testEndpoint) lines() []int {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	var lines []int
+	for _, body := range e.bodies {
+		lines = append(lines, bytes.Count(body, []byte("\n")))
+	}
+	return lines
+}
+
+// newTestHTTPWriter to the endpoint, writing NDJSON without retries
+func newTestHTTPWriter(t *testing.T, srv *httptest.Server) *httpWriter {
+	t.Helper()
+	setFlag(t, "output-format", outputFormatNDJSON)
+	timestampLocation = time.UTC
+
+	return &httpWriter{
+		client: srv.Client(),
+		url:    srv.URL,
+		method: http.MethodPost,
+		header: make(http.Header),
+	}
+}
+
+// testBatch of n messages, a second apart
+func testBatch(n int) batch {
+	ts := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	msgs := make([]messages.ParsedMessage, n)
+	for i := range msgs {
+		msgs[i] = messages.ParsedMessage{
+			Timestamp:   ts.Add(time.Duration(i) * time.Second),
+			InsertID:    fmt.Sprint(i),
+			TextPayload: fmt.Sprintf("[1]: message %d", i),
+		}
+	}
+	return batch{msgs: msgs}
+}
+
+func TestWriteChunksBoundaries(t *testing.T) {
+	tests := []struct {
+		messages int
+		want     []int
+	}{
+		{messages: 0, want: nil},
+		{messages: 2, want: []int{2}},
+		{messages: 3, want: []int{3}},
+		{messages: 4, want: []int{3, 1}},
+		{messages: 7, want: []int{3, 3, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.messages), func(t *testing.T) {
+			endpoint, srv := newTestEndpoint(t)
+			w := newTestHTTPWriter(t, srv)
+			setFlag(t, "http-batch-size", "3")
+
+			if err := writeChunks(w, testBatch(tt.messages)); err != nil {
+				t.Fatal(err)
+			}
+			if got := endpoint.lines(); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("sent requests of %v messages, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteChunksSplitsByBytes(t *testing.T) {
+	endpoint, srv := newTestEndpoint(t)
+	w := newTestHTTPWriter(t, srv)
+	setFlag(t, "http-batch-size", "0")
+
+	// Each message is over half the limit, and one over it is still sent
+	buf, _, err := formatBatch(testBatch(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, "http-batch-bytes", fmt.Sprint(buf.Len()+buf.Len()/2))
+	b := testBatch(4)
+	b.msgs[3].TextPayload += string(bytes.Repeat([]byte("x"), 2*buf.Len()))
+
+	if err := writeChunks(w, b); err != nil {
+		t.Fatal(err)
+	}
+	if got := endpoint.lines(); fmt.Sprint(got) != "[1 1 1 1]" {
+		t.Errorf("sent requests of %v messages, want one each", got)
+	}
+}
+
+func TestWriteChunksReportsPartialProgress(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    string
+		bytes   string
+		fail    int
+		written int
+	}{
+		{name: "first request", size: "3", fail: 1, written: 0},
+		{name: "later request", size: "3", fail: 2, written: 3},
+		{name: "last request", size: "3", fail: 3, written: 6},
+		{name: "halved by bytes", size: "0", bytes: "1", fail: 2, written: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, srv := newTestEndpoint(t, tt.fail)
+			w := newTestHTTPWriter(t, srv)
+			setFlag(t, "http-batch-size", tt.size)
+			if tt.bytes != "" {
+				setFlag(t, "http-batch-bytes", tt.bytes)
+			}
+
+			b := testBatch(7)
+			if tt.bytes != "" {
+				b = testBatch(2)
+			}
+			err := writeChunks(w, b)
+			if err == nil {
+				t.Fatal("write succeeded, want it to fail")
+			}
+			if got := writtenBefore(err); got != tt.written {
+				t.Errorf("got %d messages written before %q, want %d", got, err, tt.written)
+			}
+		})
+	}
+}
+
+func TestFlushRetriesOnlyUnsentChunks(t *testing.T) {
+	endpoint, srv := newTestEndpoint(t, 2)
+	w := newTestHTTPWriter(t, srv)
+	setFlag(t, "http-batch-size", "3")
+	setFlag(t, "on-output-error", outputErrorRetry)
+	captureLogs(t)
+	t.Cleanup(func() { outputFailing = false })
+
+	buf, _ := newTestBuffer(t)
+	buf.out = w
+	for _, pm := range testBatch(7).msgs {
+		buf.insert(pm)
+	}
+
+	// The first request is accepted and the second fails, leaving its
+	// messages and those after them for the next flush
+	buf.Flush(false)
+	if buf.Len() != 4 {
+		t.Fatalf("%d messages left in the buffer, want 4", buf.Len())
+	}
+	buf.Flush(false)
+	if buf.Len() != 0 {
+		t.Fatalf("%d messages left in the buffer, want none", buf.Len())
+	}
+
+	if got := endpoint.lines(); fmt.Sprint(got) != "[3 3 3 1]" {
+		t.Errorf("sent requests of %v messages, want [3 3 3 1]", got)
+	}
+	endpoint.mx.Lock()
+	defer endpoint.mx.Unlock()
+	if !bytes.Contains(endpoint.bodies[2], []byte("message 3")) || bytes.Contains(endpoint.bodies[2], []byte("message 0")) {
+		t.Errorf("retried %q, want only the messages of the failed and later requests", endpoint.bodies[2])
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Time the last message was received, in Unix nanoseconds
+	lastReceived atomic.Int64
+
+	// Time a message was last received or flushed, in Unix nanoseconds
+	lastActivity atomic.Int64
+
+	// Set while no message has been received for -idle-warn-after
+	idle atomic.Bool
+
+	// Number of sources receiving, one per subscription once subscribed to
+	// Pub/Sub
+	receivers atomic.Int32
+)
+
+// noteReceived message, ending an idle period
+func noteReceived() {
+	lastReceived.Store(time.Now().UnixNano())
+	noteActivity()
+
+	if idle.CompareAndSwap(true, false) {
+		metricSubscriptionIdle.Set(0)
+		logger.Info("receiving messages again after being idle")
+	}
+}
+
+// watchIdle subscription, warning once no message has been received for d
+func watchIdle(d time.Duration) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		last := time.Unix(0, lastReceived.Load())
+		if last.Before(startTime) {
+			last = startTime
+		}
+
+		if time.Since(last) >= d && idle.CompareAndSwap(false, true) {
+			metricSubscriptionIdle.Set(1)
+			logger.Warn("no messages received, the source may be broken", "idle", time.Since(last).Round(time.Second).String())
+		}
+	}
+}
+
+// noteActivity of the pipeline, a message received or flushed
+func noteActivity() {
+	lastActivity.Store(time.Now().UnixNano())
+}
+
+// inactive reports whether no message has been received or flushed within
+// -readiness-activity-timeout
+func inactive() bool {
+	if *flagReadinessActivityTimeout <= 0 {
+		return false
+	}
+
+	last := time.Unix(0, lastActivity.Load())
+	if last.Before(startTime) {
+		last = startTime
+	}
+	return time.Since(last) > *flagReadinessActivityTimeout
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// notePublished time of a received message in published, keeping the most
+// recent one, in Unix nanoseconds
+func notePublished(published *atomic.Int64, t time.Time) {
+	n := t.UnixNano()
+	for {
+		last := published.Load()
+		if n <= last || published.CompareAndSwap(last, n) {
+			return
+		}
+	}
+}
+
+// watchLag of the subscription, calling reset once the most recent message
+// received from it was published more than d ago. The lag is only measured
+// from the given time on, so that a new client gets as long to catch up.
+func watchLag(ctx context.Context, name string, published *atomic.Int64, d time.Duration, since time.Time, reset func()) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		last := time.Unix(0, published.Load())
+		if last.Before(since) {
+			last = since
+		}
+
+		if lag := time.Since(last); lag >= d {
+			logger.Warn("subscription lagging, recreating the Pub/Sub client", "subscription", name, "lag", lag.Round(time.Second).String())
+			reset()
+			return
+		}
+	}
+}
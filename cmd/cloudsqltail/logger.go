@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// Formats supported by -log-format
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logger for the diagnostics of the tool itself, which go to STDERR so that
+// they never mix with the flushed messages on STDOUT
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// setupLogger according to the -log-format and -log-level flags
+func setupLogger() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*flagLogLevel)); err != nil {
+		return errors.New(fmt.Sprintf("unknown log level '%s'", *flagLogLevel))
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	switch *flagLogFormat {
+	case logFormatText:
+		logger = slog.New(slog.NewTextHandler(os.Stderr, opts))
+	case logFormatJSON:
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	default:
+		return errors.New(fmt.Sprintf("unknown log format '%s'", *flagLogFormat))
+	}
+
+	return nil
+}
@@ -6,206 +6,2474 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"runtime"
-	"sort"
-	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
+	// Embed the time zone database for -timezone, as the image lacks one
+	_ "time/tzdata"
 
 	"cloud.google.com/go/pubsub"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/netutil"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"cloudsqltail/messages"
 )
 
+const (
+	// pgTimestampFormat is the timestamp format that Postgres uses in its log line prefix
+	pgTimestampFormat = "2006-01-02 15:04:05.999999999 UTC"
+
+	// heartbeatPayload is the text emitted in place of a log line by a heartbeat,
+	// so that it can easily be filtered out downstream
+	heartbeatPayload = "[cloudsqltail]: heartbeat"
+
+	// maxReceiveGoroutines that a subscription is received with, as each
+	// opens a stream of its own
+	maxReceiveGoroutines = 256
+
+	// rawPayloadPrefix marks the raw content of a message that could not be
+	// parsed, when emitted with -emit-raw-on-error
+	rawPayloadPrefix = "[cloudsqltail]: unparseable message: "
+)
+
+// Policies supported by -overflow-policy
+const (
+	overflowBlock = "block"
+	overflowAck   = "ack"
+	overflowNack  = "nack"
+)
+
 var (
 	// Flags used for configuration
+	flagConfig            = flag.String("config", "", "YAML or JSON file of options, keyed by flag name. Flags given on the command line take precedence.")
+	flagPrintConfigJSON   = flag.Bool("print-config-json", false, "Print the resolved options, defaults included, as JSON to STDOUT and exit.")
+	flagVersion           = flag.Bool("version", false, "Print the version, commit and build date, and exit.")
 	flagProject           = flag.String("project", "", "GCP Project ID")
-	flagSubscription      = flag.String("subscription", "", "GCP Pub/Sub Subscription name")
+	flagSource            = flag.String("source", sourcePubSub, "Where to read log entries from: \"pubsub\", \"logging\" (the Cloud Logging API) or \"stdin\" (newline-delimited JSON).")
+	flagSubscription      = flag.String("subscription", "", "GCP Pub/Sub Subscription name, or a comma-separated list of them to receive from all at once")
 	flagReceiveGoroutines = flag.Int(
 		"recv-routines",
 		runtime.NumCPU(),
 		"Number of goroutines to use to receive messages from the Pub/Sub Subscription. [default: runtime.NumCPUs()]",
 	)
+	flagCredentialsFile = flag.String(
+		"credentials-file",
+		"",
+		"Service account key file to authenticate with. [default: \"\", the application default credentials]",
+	)
+	flagImpersonateServiceAccount = flag.String(
+		"impersonate-service-account",
+		"",
+		"Service account to impersonate, with the application default credentials, instead of using them directly.",
+	)
+	flagLoggingFilter = flag.String(
+		"logging-filter",
+		`resource.type="cloudsql_database"`,
+		"Cloud Logging filter selecting the entries to read with -source=logging.",
+	)
+	flagPollInterval = flag.Duration(
+		"poll-interval",
+		10*time.Second,
+		"Time between polls of the Cloud Logging API with -source=logging.",
+	)
+	flagLogFormat = flag.String(
+		"log-format",
+		logFormatText,
+		"Format of the diagnostic logs on STDERR: \"text\" or \"json\".",
+	)
+	flagLogLevel = flag.String(
+		"log-level",
+		"info",
+		"Minimum level of the diagnostic logs on STDERR: \"debug\", \"info\", \"warn\" or \"error\".",
+	)
+	flagMaxProcs = flag.Int(
+		"max-procs",
+		runtime.GOMAXPROCS(0),
+		"Maximum number of CPUs that can be executing simultaneously (GOMAXPROCS). [default: runtime.GOMAXPROCS(0)]",
+	)
+	flagExclusive = flag.Bool(
+		"exclusive",
+		false,
+		"Refuse to start unless the subscription configuration can be read and is a plain pull subscription for this process to consume.",
+	)
+	flagStrictConfig = flag.Bool(
+		"strict-config",
+		false,
+		"Refuse to start if the flush interval is not compatible with how long the subscription lets messages wait unacknowledged, instead of warning.",
+	)
+	flagBacklogOnly = flag.Bool(
+		"backlog-only",
+		false,
+		"Only process the messages published before the process started, leaving newer ones unacknowledged for redelivery.",
+	)
+	flagBacklogExitAfter = flag.Duration(
+		"backlog-exit-after",
+		0,
+		"With -backlog-only, stop once no message of the backlog has been received for this long. [default: 0, keep running]",
+	)
+	flagAdaptiveDrain = flag.Bool(
+		"adaptive-drain",
+		false,
+		"Receive with more goroutines while the subscription backlog, read from Cloud Monitoring, is over -adaptive-drain-backlog, then settle to -recv-routines.",
+	)
+	flagAdaptiveDrainBacklog = flag.Int64(
+		"adaptive-drain-backlog",
+		10000,
+		"Number of undelivered messages above which -adaptive-drain boosts receiving.",
+	)
+	flagAdaptiveDrainRoutines = flag.Int(
+		"adaptive-drain-routines",
+		0,
+		"Number of goroutines to receive with while -adaptive-drain boosts receiving. [default: 0, 4 × -recv-routines]",
+	)
+	flagGRPCConns = flag.Int(
+		"grpc-conns",
+		4,
+		"Number of gRPC connections in the Pub/Sub client pool. The -recv-routines goroutines share these connections, so raise both together for high-throughput subscriptions.",
+	)
+	flagEmulatorHost = flag.String(
+		"emulator-host",
+		os.Getenv("PUBSUB_EMULATOR_HOST"),
+		"Address of a Pub/Sub emulator to receive from instead of Pub/Sub, without credentials. [default: $PUBSUB_EMULATOR_HOST]",
+	)
+	flagProfile = flag.String(
+		"profile",
+		"",
+		"Defaults for the flush interval, buffer size, receive goroutines and outstanding messages: \"low-latency\", \"balanced\" or \"high-throughput\". Options that are set explicitly take precedence.",
+	)
+	flagMaxOutstandingMessages = flag.Int(
+		"max-outstanding-messages",
+		pubsub.DefaultReceiveSettings.MaxOutstandingMessages,
+		"Maximum number of Pub/Sub messages received but not yet acknowledged. [0 or less for no limit]",
+	)
+	flagMaxOutstandingBytes = flag.Int(
+		"max-outstanding-bytes",
+		pubsub.DefaultReceiveSettings.MaxOutstandingBytes,
+		"Maximum size in bytes of the Pub/Sub messages received but not yet acknowledged. [0 or less for no limit]",
+	)
+	flagEnforceOrdering = flag.Bool(
+		"enforce-ordering",
+		false,
+		"Preserve the delivery order of messages sharing an ordering key, on subscriptions with message ordering enabled. [default: false]",
+	)
 	flagFlushInterval = flag.Duration(
 		"flush-interval",
 		5*time.Second,
 		"Time between flushes of message slice to STDOUT.",
 	)
+	flagInitialFlushDelay = flag.Duration(
+		"initial-flush-delay",
+		0,
+		"Delay the first flush by this much on top of -flush-interval, to sort more of the backlog received on startup together. [default: 0, no delay]",
+	)
+	flagBufferSize = flag.Int(
+		"buffer-size",
+		0,
+		"Maximum number of messages held in memory between flushes. [default: 0, unlimited]",
+	)
+	flagBufferBytes = flag.Int(
+		"buffer-bytes",
+		0,
+		"Maximum total size in bytes of the payloads held in memory between flushes, as an alternative to -buffer-size. [default: 0, unlimited]",
+	)
+	flagForceFlushBytes = flag.Int(
+		"force-flush-bytes",
+		0,
+		"Flush right away, with a warning, whenever the payloads held in memory grow past this many bytes. [default: 0, disabled]",
+	)
+	flagFlushCount = flag.Int(
+		"flush-count",
+		0,
+		"Flush right away whenever this many messages are buffered, besides on every -flush-interval. [default: 0, on the interval only]",
+	)
+	flagMaxBuffer = flag.Int(
+		"max-buffer",
+		0,
+		"Flush right away, with a warning, whenever this many messages are held in memory, instead of waiting for the next tick. [default: 0, disabled]",
+	)
+	flagFlushOnSeverity = flag.String(
+		"flush-on-severity",
+		"",
+		"Flush right away whenever a message at least this severe (such as \"ERROR\") is buffered, instead of waiting for the next tick. [default: \"\", disabled]",
+	)
+	flagMaxLinesPerSecond = flag.Int(
+		"max-lines-per-second",
+		0,
+		"Write at most this many messages per second on average, leaving the others buffered for the following flushes. [default: 0, no limit]",
+	)
+	flagMaxAge = flag.Duration(
+		"max-age",
+		0,
+		"Skip the messages with a timestamp older than this when flushing, such as a stale backlog redelivered after an outage. [default: 0, keep all]",
+	)
+	flagMinSeverity = flag.String(
+		"min-severity",
+		"",
+		"Skip the messages less severe than this (such as \"WARNING\") when flushing. Messages without a severity are kept. [default: \"\", keep all]",
+	)
+	flagOverflowPolicy = flag.String(
+		"overflow-policy",
+		overflowBlock,
+		"What to do with a message received while the buffer is full: \"block\" until the next flush, or shed it with an \"ack\" (dropped) or a \"nack\" (redelivered).",
+	)
+	flagMaxMessageBytes = flag.Int(
+		"max-message-bytes",
+		0,
+		"Reject received messages larger than this many bytes, before parsing them. [default: 0, no limit]",
+	)
+	flagOversizedPolicy = flag.String(
+		"oversized-policy",
+		overflowAck,
+		"What to do with a message over -max-message-bytes: \"ack\" (dropped) or \"nack\" (redelivered).",
+	)
+	flagInvalidPolicy = flag.String(
+		"invalid-policy",
+		overflowAck,
+		"What to do with a message that is not valid JSON: \"ack\" (dropped, or emitted with -emit-raw-on-error) or \"nack\" (redelivered, to reach a dead-letter topic).",
+	)
+	flagPanicPolicy = flag.String(
+		"panic-policy",
+		overflowAck,
+		"What to do with a message whose handling panicked: \"ack\" (dropped) or \"nack\" (redelivered).",
+	)
+	flagHighWaterMark = flag.Int(
+		"high-water-mark",
+		0,
+		"Buffer depth above which message intake is throttled to a single receive goroutine. [default: 0, never throttle]",
+	)
+	flagLowWaterMark = flag.Int(
+		"low-water-mark",
+		0,
+		"Buffer depth at or below which throttled message intake is restored to -recv-routines.",
+	)
+	flagCountOutOfOrder = flag.Bool(
+		"count-out-of-order",
+		false,
+		"Count how many messages arrived with an earlier timestamp than the message before them, in the out_of_order_total metric.",
+	)
+	flagSortStrategy = flag.String(
+		"sort-strategy",
+		sortSlice,
+		"How buffered messages are sorted: \"slice\" sorts them all at each flush, \"heap\" keeps them in a heap as they arrive.",
+	)
+	flagSortBy = flag.String(
+		"sort-by",
+		sortByCloudTimestamp,
+		"Timestamp messages are sorted by: \"cloud-timestamp\" (of the log entry) or \"line-timestamp\" (of the Postgres line prefix, see -line-timestamp-format, falling back to that of the log entry).",
+	)
+	flagLineTimestampFormat = flag.String(
+		"line-timestamp-format",
+		pgTimestampFormat,
+		"Go time layout of the timestamp in a bracketed field of the Postgres line prefix, with -sort-by=line-timestamp.",
+	)
+	flagTimestampFormat = flag.String(
+		"timestamp-format",
+		pgTimestampFormat,
+		"Go time layout of the timestamp prepended to the lines of the text output format, matching Postgres by default.",
+	)
+	flagTimezone = flag.String(
+		"timezone",
+		"UTC",
+		"Time zone of the timestamp prepended to the lines of the text output format, such as \"Local\" or \"Europe/Paris\".",
+	)
+	flagGroupBySession = flag.Bool(
+		"group-by-session",
+		false,
+		"Within each flush, write the lines of each session together, in the order of the first line of each session.",
+	)
+	flagSessionPattern = flag.String(
+		"session-pattern",
+		`^\[(\d+)\]:`,
+		"Regular expression extracting the session ID of a line for -group-by-session, from its first capture group. [default: the process ID of the Cloud SQL log line prefix]",
+	)
+	flagSortOrder = flag.String(
+		"sort-order",
+		sortAsc,
+		"Order of the messages within each flush: \"asc\" (oldest first) or \"desc\" (newest first).",
+	)
+	flagLateness = flag.Duration(
+		"lateness",
+		0,
+		"Only flush messages older than this, so that late arrivals within the window are sorted into place. [default: 0, flush everything]",
+	)
+	flagMaxFutureSkew = flag.Duration(
+		"max-future-skew",
+		0,
+		"Replace timestamps more than this far in the future with the current time, counting them in the clamped_timestamps_total metric. [default: 0, keep them]",
+	)
+	flagMaxMessageResidence = flag.Duration(
+		"max-message-residence",
+		0,
+		"Flush every buffered message, regardless of -lateness, once one has been buffered for this long. [default: 0, no limit]",
+	)
+	flagHeartbeatInterval = flag.Duration(
+		"heartbeat-interval",
+		0,
+		"Emit a synthetic heartbeat line when no messages have been flushed for this long. [default: 0, disabled]",
+	)
+	flagTimestampField = flag.String(
+		"timestamp-field",
+		"",
+		"Dot-separated JSON path to the RFC 3339 timestamp to sort messages by, such as \"receiveTimestamp\". Messages without it fall back to \"timestamp\".",
+	)
+	flagFallbackTextPath = flag.String(
+		"fallback-text-path",
+		"",
+		"Dot-separated JSON path to the text payload, tried when a message has neither a timestamp nor a textPayload.",
+	)
+	flagFallbackTimestampPath = flag.String(
+		"fallback-timestamp-path",
+		"",
+		"Dot-separated JSON path to the RFC 3339 timestamp, tried when a message has neither a timestamp nor a textPayload.",
+	)
+	flagInvalidUTF8 = flag.String(
+		"invalid-utf8",
+		invalidUTF8Repair,
+		"What to do with invalid UTF-8 in the payloads: \"repair\" it with U+FFFD replacement characters, \"drop\" the invalid bytes or \"keep\" them (in payloads not decoded from JSON).",
+	)
+	flagInputEncoding = flag.String(
+		"input-encoding",
+		inputEncodingUTF8,
+		"Character encoding of the text payloads of the received messages, transcoded to UTF-8: \"utf8\", \"latin1\" (ISO 8859-1) or \"windows-1252\".",
+	)
+	flagEmitRawOnError = flag.Bool(
+		"emit-raw-on-error",
+		false,
+		"Emit the raw content of messages that are not valid JSON, marked and timestamped with the current time, instead of dropping them.",
+	)
+	flagStripANSI = flag.Bool(
+		"strip-ansi",
+		false,
+		"Remove ANSI escape sequences, such as colors, from the text payloads.",
+	)
+	flagRedactBindParams = flag.Bool(
+		"redact-bind-params",
+		false,
+		"Mask the values of bind parameters in the \"parameters: $1 = '...'\" lines that Postgres logs.",
+	)
+	flagRedactMask = flag.String(
+		"redact-mask",
+		"[REDACTED]",
+		"Token that redacted content is replaced with.",
+	)
+	flagDatabaseAllowlist = flag.String(
+		"database-allowlist",
+		"",
+		"Comma separated database ids (resource.labels.database_id) to process the entries of, skipping the others. [default: \"\", process all]",
+	)
+	flagValidateSchema = flag.Bool(
+		"validate-schema",
+		false,
+		"Reject messages without a timestamp and one of the payload fields, counting them in the messages_invalid_total metric.",
+	)
+	flagWALPath = flag.String(
+		"wal-path",
+		"",
+		"Write-ahead log file that buffered messages are also appended to, and replayed from on startup, so that they survive a restart. [default: \"\", buffer in memory only]",
+	)
+	flagWALMaxSize = flag.Int64(
+		"wal-max-size",
+		100*1024*1024,
+		"Maximum size of the write-ahead log in bytes, past which messages are only buffered in memory until the next flush. [default: 100MiB, 0 for no limit]",
+	)
+	flagDedupeWindow = flag.Int(
+		"dedupe-window",
+		0,
+		"Number of the most recently written insert IDs remembered in memory, to drop messages delivered again. [default: 0, disabled]",
+	)
+	flagDedupeBloomPath = flag.String(
+		"dedupe-bloom-path",
+		"",
+		"File that a Bloom filter of the insert IDs written is persisted to, and loaded from on startup, to drop messages delivered again even across restarts. [default: \"\", no deduplication]",
+	)
+	flagDedupeBloomCapacity = flag.Uint64(
+		"dedupe-bloom-capacity",
+		1000000,
+		"Number of insert IDs the dedupe filter holds at -dedupe-bloom-fp-rate, after which a new one is started and the oldest is forgotten.",
+	)
+	flagDedupeBloomFPRate = flag.Float64(
+		"dedupe-bloom-fp-rate",
+		0.001,
+		"Rate of messages wrongly dropped as duplicates by a full dedupe filter.",
+	)
+	flagDedupeBloomInterval = flag.Duration(
+		"dedupe-bloom-interval",
+		time.Minute,
+		"How often the dedupe filter is persisted, besides on shutdown.",
+	)
+	flagDeadletterFile = flag.String(
+		"deadletter-file",
+		"",
+		"File that rejected messages are appended to, one per line. [default: \"\", discard them]",
+	)
+	flagErrorOutput = flag.String(
+		"error-output",
+		"",
+		"File that a JSON record of each parsing and output error is appended to, with its stage and message ID. [default: \"\", only log errors]",
+	)
+	flagOutput = flag.String(
+		"output",
+		outputStdout,
+		"Where flushed messages are written: \"stdout\", \"unixsocket\" (see -socket-path), \"http\" (see -http-url), \"file\" (see -output-file), \"gcs\" (see -gcs-bucket) or \"honeycomb\" (see -honeycomb-writekey).",
+	)
+	flagOutputFile = flag.String(
+		"output-file",
+		"",
+		"Path of the file to write flushed messages to with -output=file.",
+	)
+	flagOutputFileMode = flag.String(
+		"output-file-mode",
+		fileModeAppend,
+		"Whether -output-file is appended to (\"append\") or truncated when it is opened (\"truncate\").",
+	)
+	flagOutputFileWindow = flag.Duration(
+		"output-file-window",
+		0,
+		"Roll -output-file over to a new file, named after the time it was started, at the start of every window of this length. [default: 0, a single file]",
+	)
+	flagGCSBucket = flag.String(
+		"gcs-bucket",
+		"",
+		"Cloud Storage bucket to write flushed messages to with -output=gcs.",
+	)
+	flagGCSPrefix = flag.String(
+		"gcs-prefix",
+		"",
+		"Prefix of the names of the objects written with -output=gcs, followed by the time each was started.",
+	)
+	flagGCSWindow = flag.Duration(
+		"gcs-window",
+		10*time.Minute,
+		"Length of the window of flushed messages buffered and written as one object with -output=gcs.",
+	)
+	flagGCSCompression = flag.String(
+		"gcs-compression",
+		gcsCompressionGzip,
+		"Compression of the objects written with -output=gcs: \"gzip\" or \"none\".",
+	)
+	flagGzip = flag.Bool(
+		"gzip",
+		false,
+		"Compress what is written to -output-file with gzip, as one gzip member per flush.",
+	)
+	flagMinFreeBytes = flag.Int64(
+		"min-free-bytes",
+		0,
+		"Fail writes to -output-file, and apply -overflow-policy to received messages, while the disk it is on has less than this many bytes free. [default: 0, disabled]",
+	)
+	flagHoneycombWriteKey = flag.String(
+		"honeycomb-writekey",
+		"",
+		"Honeycomb write key (API key) that events are sent with, with -output=honeycomb.",
+	)
+	flagHoneycombDataset = flag.String(
+		"honeycomb-dataset",
+		"postgres",
+		"Honeycomb dataset that events are sent to, with -output=honeycomb.",
+	)
+	flagHoneycombAPIHost = flag.String(
+		"honeycomb-api-host",
+		"https://api.honeycomb.io",
+		"Honeycomb API host that events are sent to, with -output=honeycomb.",
+	)
+	flagSocketPath = flag.String(
+		"socket-path",
+		"",
+		"Path of the Unix domain socket to write flushed messages to with -output=unixsocket.",
+	)
+	flagAtomicFileWrites = flag.Bool(
+		"atomic-file-writes",
+		false,
+		"Write each file of -output=file under a .tmp name, and rename it to its final name once it is complete, so that readers only see complete files.",
+	)
+	flagHTTPURL = flag.String(
+		"http-url",
+		"",
+		"URL of the endpoint that each flush is sent to with -output=http.",
+	)
+	flagHTTPMethod = flag.String(
+		"http-method",
+		http.MethodPost,
+		"HTTP method of the requests made with -output=http.",
+	)
+	flagHTTPRetries = flag.Int(
+		"http-retries",
+		3,
+		"Number of times a failed request made with -output=http or -output=honeycomb is retried, with the -retry-backoff-* backoff, before giving up.",
+	)
+	flagRetryBackoffBase = flag.Duration(
+		"retry-backoff-base",
+		time.Second,
+		"Backoff before the first retry of a failed output write, connection or receive, growing with each further retry.",
+	)
+	flagRetryBackoffMax = flag.Duration(
+		"retry-backoff-max",
+		30*time.Second,
+		"Maximum backoff between retries of a failed output write, connection or receive.",
+	)
+	flagRetryBackoffMultiplier = flag.Float64(
+		"retry-backoff-multiplier",
+		2,
+		"Factor the backoff between retries grows by with each retry.",
+	)
+	flagRetryJitter = flag.String(
+		"retry-jitter",
+		retryJitterFull,
+		"Jitter applied to the backoff between retries: \"full\" (between 0 and the backoff), \"equal\" (between half and all of it) or \"none\".",
+	)
+	flagHTTPBatchSize = flag.Int(
+		"http-batch-size",
+		1000,
+		"Maximum number of messages sent in a single request with -output=http or -output=honeycomb, a larger flush being split over several. [0 for no limit]",
+	)
+	flagHTTPBatchBytes = flag.Int(
+		"http-batch-bytes",
+		5000000,
+		"Maximum size of the body of a single request with -output=http or -output=honeycomb, larger batches being split further. [0 for no limit]",
+	)
+	flagFlushStats = flag.String(
+		"flush-stats",
+		"",
+		"Write an event with the statistics of each flush, marked with \"_flush_stats\", to the \"output\" itself (with -output-format=ndjson) or to this file. [default: \"\", do not]",
+	)
+	flagSplitOutput = flag.String(
+		"split-output",
+		"",
+		"Write the text output lines that continue a message sequence (not starting with \"[\") to \"stderr\" or to this file instead. [default: \"\", keep them in the output]",
+	)
+	flagOutputFormat = flag.String(
+		"output-format",
+		outputFormatText,
+		"Format of the flushed output: \"text\" (for honeytail), \"ndjson\" or \"json\" (one JSON event per line), \"json-array\" (one JSON array per flush) or \"parquet\" (one row group per flush, with -output=file).",
+	)
+	flagParseCSVLog = flag.Bool(
+		"parse-csvlog",
+		false,
+		"Parse payloads in the Postgres csvlog format (log_destination=csvlog) into a JSON field per column, with the JSON output formats.",
+	)
+	flagParsePGAudit = flag.Bool(
+		"parse-pgaudit",
+		false,
+		"Parse the pgaudit records of payloads (\"AUDIT: SESSION,...\") into a JSON field per column, with the JSON output formats.",
+	)
+	flagParsePGPrefix = flag.Bool(
+		"parse-pg-prefix",
+		false,
+		"Parse the log_line_prefix of payloads with -pg-prefix-pattern into a \"pg.\" JSON field per named group, with the JSON output formats.",
+	)
+	flagPGPrefixPattern = flag.String(
+		"pg-prefix-pattern",
+		`^\[(?P<pid>\d+)\]: \[(?P<line>\d+)-\d+\] db=(?P<database>[^,]*),user=(?P<user>\S*) (?P<message>(?s:.*))$`,
+		"Regular expression matching the log_line_prefix for -parse-pg-prefix, with a named group per field and the rest of the line in the \"message\" group. [default: the Cloud SQL log line prefix]",
+	)
+	flagParseEmbeddedJSON = flag.Bool(
+		"parse-embedded-json",
+		false,
+		"Write the fields of payloads that are a JSON object as fields of the event instead of as the message, with the JSON output formats.",
+	)
+	flagCoalesceOperations = flag.Bool(
+		"coalesce-operations",
+		false,
+		"Write the entries of an operation that are flushed together as one event, with their payloads joined by newlines.",
+	)
+	flagAddDatabaseID = flag.Bool(
+		"add-database-id",
+		false,
+		"Add the Cloud SQL instance that logged each entry (resource.labels.database_id) to the JSON events, as \"database_id\".",
+	)
+	flagAddSubscription = flag.Bool(
+		"add-subscription",
+		false,
+		"Add the name of the Pub/Sub subscription each entry was received from to the JSON events, as \"pubsub_subscription\", to tell several -subscription apart.",
+	)
+	flagCoalesceContinuations = flag.Bool(
+		"coalesce-continuations",
+		false,
+		"Write the continuation lines of a multi-line entry as one event with its first line, with their payloads joined by newlines.",
+	)
+	flagAddMessageID = flag.Bool(
+		"add-message-id",
+		false,
+		"Write the ID of the Pub/Sub message each entry was delivered in as the pubsub_message_id field of the events, with the JSON output formats.",
+	)
+	flagAddSequence = flag.Bool(
+		"add-sequence",
+		false,
+		"Write a sequence number, increasing by one for each event, as the sequence field of the events, with the JSON output formats.",
+	)
+	flagSequenceStateFile = flag.String(
+		"sequence-state-file",
+		"",
+		"File that the next -add-sequence number is kept in, so that the sequence continues across restarts. [default: \"\", restart from 1]",
+	)
+	flagLabelPrefix = flag.String(
+		"label-prefix",
+		"label.",
+		"Prefix of the names of the fields that the labels of the log entries are written as, with the JSON output formats.",
+	)
+	flagBatchMarker = flag.Bool(
+		"batch-marker",
+		false,
+		"End each flush with a {\"_batch\":true,\"count\":N,\"flushed_at\":...} record, with -output-format=ndjson.",
+	)
+	flagFieldOrder = flag.String(
+		"field-order",
+		"timestamp,severity,message",
+		"Comma separated order of the fields of the events in the JSON output formats. Fields not listed follow in their default order.",
+	)
+	flagTemplate = flag.String(
+		"template",
+		"",
+		"Go text/template of each line in the text output format, replacing the built-in one, e.g. '{{.Timestamp}} {{.DatabaseID}} {{.TextPayload}}'. Fields: .Timestamp, .Severity, .TextPayload, .InsertID and .DatabaseID.",
+	)
+	flagLinePrefix = flag.String(
+		"line-prefix",
+		"",
+		"String written before each line in the text output format.",
+	)
+	flagLineSuffix = flag.String(
+		"line-suffix",
+		"",
+		"String written after each line (before the newline) in the text output format.",
+	)
+	flagColor = flag.String(
+		"color",
+		colorNever,
+		"Color the lines of the text output format by severity: \"auto\" (when STDOUT is a terminal), \"always\" or \"never\".",
+	)
+	flagLineEnding = flag.String(
+		"line-ending",
+		lineEndingLF,
+		"Line ending of the text and JSON output formats: \"lf\" or \"crlf\".",
+	)
+	flagOnOutputError = flag.String(
+		"on-output-error",
+		outputErrorExit,
+		"What to do when writing the output fails: \"exit\", \"drop\" the batch, or \"retry\" it on the next flush while pausing receiving.",
+	)
+	flagFatalFlushTimeout = flag.Duration(
+		"fatal-flush-timeout",
+		5*time.Second,
+		"How long to spend flushing the messages already received before exiting on a fatal error. [0 to exit immediately]",
+	)
+	flagDrainTimeout = flag.Duration(
+		"drain-timeout",
+		0,
+		"How long to spend flushing the remaining messages on shutdown. [default: 0, no limit]",
+	)
+	flagCloseTimeout = flag.Duration(
+		"close-timeout",
+		5*time.Second,
+		"How long to spend closing the outputs on shutdown, once the remaining messages are flushed. [0 for no limit]",
+	)
+	flagHTTPShutdownTimeout = flag.Duration(
+		"http-shutdown-timeout",
+		5*time.Second,
+		"How long to let in-flight requests to the health and metrics server complete on shutdown.",
+	)
+	flagMaxRuntime = flag.Duration(
+		"max-runtime",
+		0,
+		"Stop receiving after running for this long, flush the remaining messages and exit. [default: 0, run forever]",
+	)
+	flagMaxEvents = flag.Uint64(
+		"max-events",
+		0,
+		"Stop receiving once this many messages have been flushed, and exit. [default: 0, no limit]",
+	)
+	flagNoHTTP = flag.Bool(
+		"no-http",
+		false,
+		"Do not start the health and metrics HTTP server, for CLI and batch runs. Metrics can still be logged with -metrics-log-interval.",
+	)
+	flagHTTPAddr = flag.String(
+		"http-addr",
+		":5000",
+		"Address the health and metrics HTTP server listens on, as host:port. An empty address does not start it, as with -no-http.",
+	)
+	flagHealthMaxConns = flag.Int(
+		"health-max-conns",
+		256,
+		"Maximum number of concurrent connections accepted by the health and metrics HTTP server.",
+	)
+	flagHTTPBearerToken = flag.String(
+		"http-bearer-token",
+		"",
+		"Token that requests to the health and metrics HTTP server must give as 'Authorization: Bearer <token>'. [default: none, no authentication]",
+	)
+	flagLivenessFlushTimeout = flag.Duration(
+		"liveness-flush-timeout",
+		0,
+		"Report unhealthy on /healthz when messages have been received but no flush has succeeded for this long. [default: 0, disabled]",
+	)
+	flagReadinessActivityTimeout = flag.Duration(
+		"readiness-activity-timeout",
+		time.Hour,
+		"Report not ready on /readyz when no message has been received or flushed for this long. 0 disables the check.",
+	)
+	flagDebugState = flag.Bool(
+		"debug-state",
+		false,
+		"Serve a JSON snapshot of the buffer, counters and options on /debug/state of the health server.",
+	)
+	flagIdleWarnAfter = flag.Duration(
+		"idle-warn-after",
+		0,
+		"Warn and set the subscription_idle gauge to 1 when no message has been received for this long. [default: 0, disabled]",
+	)
+	flagReceiveRetries = flag.Int(
+		"receive-retries",
+		5,
+		"Number of times in a row receiving from Pub/Sub is retried after failing, with the -retry-backoff-* backoff, before exiting. Receiving messages resets the count.",
+	)
+	flagLagResetThreshold = flag.Duration(
+		"lag-reset-threshold",
+		0,
+		"Flush, then tear down and recreate the Pub/Sub client when the most recent message received was published longer ago than this. [default: 0, disabled]",
+	)
+	flagGoroutineWatch = flag.Duration(
+		"goroutine-watch",
+		0,
+		"Log the number of goroutines this often, warning when it grows past -goroutine-watch-factor times the first count. [default: 0, disabled]",
+	)
+	flagGoroutineWatchFactor = flag.Float64(
+		"goroutine-watch-factor",
+		4,
+		"Multiple of the first goroutine count above which -goroutine-watch warns of a leak.",
+	)
+	flagMetricsLogInterval = flag.Duration(
+		"metrics-log-interval",
+		0,
+		"Log the values of the metrics as a single line on STDERR this often, for log-based metrics. [default: 0, disabled]",
+	)
+	flagSummary = flag.Bool(
+		"summary",
+		false,
+		"Log a summary of the messages received, flushed, dropped and invalid on exit. Always done with -max-runtime.",
+	)
+	flagLogFlushSummary = flag.Bool(
+		"log-flush-summary",
+		false,
+		"Log a line on STDERR after each flush with the messages received since the previous one, emitted, and skipped by reason.",
+	)
+
+	// Time of the last flush that wrote its messages, or found none waiting,
+	// in Unix nanoseconds, read by the health check without taking the lock
+	lastFlushSucceeded atomic.Int64
+
+	// Location of -timezone, that prepended timestamps are given in
+	timestampLocation *time.Location
+
+	// Level of -flush-on-severity, from which a buffered message triggers a flush
+	flushSeverity int
 
-	// Used to store messages until they are flushed to Honeycomb
-	globalMessages []messages.ParsedMessage
+	// Level of -min-severity, below which messages are skipped when flushing
+	minSeverity int
 
-	// Mutex used to protect the global messages slice
-	mx sync.Mutex
+	// Stops receiving, once -max-events messages have been flushed
+	stopReceiving context.CancelFunc = func() {}
+
+	// Database ids of -database-allowlist, nil to process all of them. Swapped
+	// as a whole when the config file is reloaded.
+	databaseAllowlist atomic.Pointer[map[string]bool]
+
+	// Set while writing the output is failing under the "retry" output error policy
+	outputFailing bool
+
+	// Repeatable and custom flags used for configuration
+	flagHTTPHeaders       stringsFlag
+	flagRedactRegex       stringsFlag
+	flagProcessors        stringsFlag
+	flagCompactWhitespace = compactFlag(compactOff)
+
+	// HTTP server for the GKE probes and metrics
+	httpServer = &http.Server{}
+
+	// Signalled when the buffer grows past -force-flush-bytes or -max-buffer,
+	// or a message of -flush-on-severity is buffered, to flush right away. The
+	// flusher only takes the lock once the receiver signalling it released it.
+	forceFlush = make(chan struct{}, 1)
 )
 
+func init() {
+	flag.Var(&flagHTTPHeaders, "http-header", "Header of the requests made with -output=http, as key=value. Can be repeated.")
+	flag.Var(&flagRedactRegex, "redact-regex", "Regular expression whose matches in the payloads are replaced with -redact-mask. Can be repeated.")
+	flag.Var(&flagProcessors, "processor", "Processor to apply to the messages about to be flushed, as name or name=arg: \"redact=regexp\" or \"add-field=key:value\". Can be repeated, applied in order.")
+	flag.Var(&flagCompactWhitespace, "compact-whitespace", "Collapse runs of whitespace, including newlines, in the payloads into single spaces. With \"safe\", quoted string literals are left alone.")
+}
+
 func main() {
 	// Parse input flags
 	err := parseFlags()
 	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "%+v\n", err)
-		os.Exit(1)
+		fatal(err)
 	}
 
-	// Create the process context
-	ctx := context.Background()
-
-	// Create the subscription to Pub/Sub
-	sub, err := subscribeToPubSub(ctx)
-	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "%+v\n", err)
-		os.Exit(1)
+	// Only show the build, if asked to
+	if *flagVersion {
+		fmt.Println(versionLine())
+		return
 	}
 
-	// Start the messages flush mechanism in a separate routine
-	go flushMessages(*flagFlushInterval)
+	// Only show the options that would be used, if asked to
+	if *flagPrintConfigJSON {
+		if err := resolvedConfig().print(os.Stdout); err != nil {
+			fatal(err)
+		}
+		return
+	}
 
-	// Serve the HTTP server in a separate routine
-	go serveHttpServer()
+	// Open the output for flushed messages, and the buffer flushed to it
+	if err := openOutput(); err != nil {
+		fatal(err)
+	}
+	buffer = NewBuffer(output)
 
-	// Start a blocking call that waits to receive new messages
-	err = sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
-		// Parse the received message
-		parseMessage(msg.Data)
+	// Open the output for the statistics of each flush
+	if err := openFlushStats(); err != nil {
+		fatal(err)
+	}
 
-		// Acknowledge that the message was received
-		msg.Ack()
-	})
-	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "%+v\n", err)
-		os.Exit(1)
+	// Open the file for rejected messages
+	if err := openDeadletter(); err != nil {
+		fatal(err)
 	}
-}
 
-// parseFlags given as input for missing or incorrect data
-func parseFlags() error {
-	flag.Parse()
+	// Open the file for structured error records
+	if err := openErrorOutput(); err != nil {
+		fatal(err)
+	}
 
-	switch "" {
-	case *flagProject:
-		return errors.New("must provide -project")
-	case *flagSubscription:
-		return errors.New("must provide -subscription")
+	// Load the sequence number to continue from
+	if err := loadSequence(); err != nil {
+		fatal(err)
 	}
 
-	if *flagReceiveGoroutines < 1 {
-		_, err := fmt.Fprintf(
-			os.Stdout,
-			`WARNING: Cannot have "%d" routines. Using default value of "%d"!`,
-			*flagReceiveGoroutines, pubsub.DefaultReceiveSettings.NumGoroutines,
-		)
-		if err != nil {
-			return err
-		}
+	// Load the insert IDs written by previous runs, before replaying any
+	if err := openDedupe(); err != nil {
+		fatal(err)
 	}
 
-	if *flagFlushInterval < 1 {
-		return errors.New(fmt.Sprintf("flush internal '%s' must be > 0", *flagFlushInterval))
-	} else if *flagFlushInterval < time.Second {
-		_, err := fmt.Fprintf(
-			os.Stdout,
-			`WARNING: Using an small flush interval may result in more out-of-order output. Are you sure you didn't mean "%ds"?`,
-			*flagFlushInterval,
-		)
-		if err != nil {
-			return err
-		}
+	// Open the write-ahead log, replaying what a previous run left in it
+	if err := openWAL(buffer); err != nil {
+		fatal(err)
 	}
 
-	return nil
-}
+	// Handle write errors on a broken STDOUT pipe ourselves, instead of
+	// letting the runtime kill the process
+	signal.Ignore(syscall.SIGPIPE)
 
-// serveHttpServer for liveliness/readiness check by GKE probe
-func serveHttpServer() {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		_, err := fmt.Fprint(w, "Alive!")
-		if err != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "could not return HTTP response: %s", err.Error())
-			os.Exit(1)
-		}
+	logger.Info("starting", "version", version, "commit", commit, "build_date", buildDate)
+
+	// Report the settings that determine how many goroutines we run
+	logger.Info(
+		"concurrency settings",
+		"gomaxprocs", runtime.GOMAXPROCS(0),
+		"recv_routines", *flagReceiveGoroutines,
+		"grpc_conns", *flagGRPCConns,
+	)
+
+	// Create the process context, cancelled on SIGINT or SIGTERM and bounded
+	// by the maximum runtime if one is set
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *flagMaxRuntime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *flagMaxRuntime)
+		defer cancel()
+	}
+	ctx, stopReceiving = context.WithCancel(ctx)
+	defer stopReceiving()
+
+	// Let the messages held while paused in once stopping, as receiving only
+	// returns once they are handled
+	context.AfterFunc(ctx, func() {
+		buffer.mx.Lock()
+		paused = false
+		buffer.intakeResumed.Broadcast()
+		buffer.mx.Unlock()
 	})
-	err := http.ListenAndServe(":5000", nil)
-	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "could not start HTTP server: %s", err.Error())
-		os.Exit(1)
+
+	// Start the messages flush mechanism in a separate routine, until
+	// shutting down
+	flushCtx, stopFlushing := context.WithCancel(context.Background())
+	flusherStopped := make(chan struct{})
+	go func() {
+		buffer.flushMessages(flushCtx, *flagFlushInterval, *flagInitialFlushDelay)
+		close(flusherStopped)
+	}()
+
+	// Flush and reload the config file on SIGHUP in a separate routine
+	go watchReload()
+
+	// Flush on SIGUSR1 in a separate routine
+	go watchFlushSignal()
+
+	// Serve the HTTP server in a separate routine, unless asked not to
+	if !*flagNoHTTP {
+		go serveHttpServer()
 	}
-}
 
-// parseMessage that is received, by taking the given JSON data,
-// parsing it and appending the ParsedMessage to the global messages slice
-func parseMessage(data []byte) {
-	var pm messages.ParsedMessage
+	// Watch for the source going quiet in a separate routine, if asked to
+	if *flagIdleWarnAfter > 0 {
+		go watchIdle(*flagIdleWarnAfter)
+	}
 
-	// Parse the JSON data
-	if err := json.Unmarshal(data, &pm); err != nil {
-		// Ignore it if it is erroneous
-		return
+	// Log the metrics in a separate routine, if asked to
+	if *flagMetricsLogInterval > 0 {
+		go logMetrics(*flagMetricsLogInterval)
+	}
+	if *flagGoroutineWatch > 0 {
+		go watchGoroutines(*flagGoroutineWatch)
+	}
+	if *flagDedupeBloomPath != "" {
+		go watchDedupe(*flagDedupeBloomInterval)
 	}
 
-	// Get a lock on the messages slice
-	mx.Lock()
-	defer mx.Unlock()
+	// Start a blocking call that waits to receive new messages
+	switch *flagSource {
+	case sourceLogging:
+		receivers.Add(1)
+		err = pollLogging(ctx)
+	case sourceStdin:
+		receivers.Add(1)
+		err = readStdin(ctx)
+	default:
+		err = receivePubSub(ctx)
+	}
+	if exitCode(ctx, err) != 0 {
+		fatal(err)
+	}
 
-	// Add the new message to the slice
-	globalMessages = append(globalMessages, pm)
+	// Receiving has stopped, so drain whatever is left in the buffer
+	stop()
+	stopFlushing()
+	shutdown(flusherStopped)
+	logSummary()
 }
 
-// subscribeToPubSub subscription in order to receive messages from logs
-func subscribeToPubSub(ctx context.Context) (*pubsub.Subscription, error) {
-	// Create a new Pub/Sub client for the given GCP project
-	c, err := pubsub.NewClient(ctx, *flagProject)
-	if err != nil {
-		return nil, err
+// exitCode of the process once receiving returned the error: 0 if it stopped
+// cleanly, including on the context being cancelled for a shutdown, or 1 on
+// any other error
+func exitCode(ctx context.Context, err error) int {
+	if err == nil || isCancellation(ctx, err) {
+		return 0
 	}
+	return 1
+}
 
-	// Subscribe into the given Pub/Sub subscription
-	sub := c.Subscription(*flagSubscription)
-	sub.ReceiveSettings.NumGoroutines = *flagReceiveGoroutines
+// isCancellation reports whether the error is only the result of the context
+// being cancelled or running out of time, which is a clean shutdown
+func isCancellation(ctx context.Context, err error) bool {
+	if ctx.Err() == nil {
+		return false
+	}
 
-	return sub, nil
-}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
 
-// flushMessages will flush the message slice on every tick
-func flushMessages(d time.Duration) {
-	// Create a ticker for that helps us wait 'dur' to flush
-	tick := time.NewTicker(d)
+	// gRPC calls report cancellation through their status instead
+	switch status.Code(err) {
+	case codes.Canceled, codes.DeadlineExceeded:
+		return true
+	}
 
-	for {
-		// Wait for the next tick
-		<-tick.C
+	return false
+}
 
-		// Get a lock on the messages slice
-		mx.Lock()
+// fatal error, which is reported before making a best-effort attempt at
+// flushing the messages that were already received, and exiting
+func fatal(err error) {
+	logger.Error(err.Error())
 
-		// If no messages available, ignore
-		if len(globalMessages) > 0 {
-			// Sort the messages by timestamp
-			sort.Slice(globalMessages, func(i, j int) bool {
-				return globalMessages[i].Timestamp.Before(globalMessages[j].Timestamp)
-			})
+	// There is nothing to drain until the output is open
+	if *flagFatalFlushTimeout > 0 && buffer != nil {
+		if withTimeout("drain", *flagFatalFlushTimeout, buffer.drain) {
+			closeOutput()
+			closeFlushStats()
+			closeDeadletter()
+			closeErrorOutput()
+			closeWAL()
+			closeDedupe()
+		}
+	}
 
-			// Run through all messages
-			for i := range globalMessages {
-				msg := &globalMessages[i]
-
-				if msg.TextPayload != "" {
-					// Print the timestamp if we have the first line in a message sequence
-					if msg.TextPayload[0] == '[' {
-						timestamp := globalMessages[i].Timestamp.Format("2006-01-02 15:04:05.999999999 UTC") // format that pg uses
-						fmt.Printf("[%s]: %s\n", timestamp, globalMessages[i].TextPayload)
-					} else {
-						fmt.Println(globalMessages[i].TextPayload)
-					}
-				}
-			}
+	os.Exit(1)
+}
+
+// parseFlags given as input for missing or incorrect data
+func parseFlags() error {
+	flag.Parse()
+	if *flagVersion {
+		return nil
+	}
+	if err := applyEnv(); err != nil {
+		return err
+	}
+	noteCommandLineOptions()
 
-			// Reset the global messages slice, pre-allocating enough capacity to
-			// fit the same number of messages as we saw last time.
-			globalMessages = make([]messages.ParsedMessage, 0, len(globalMessages))
+	// Fill in the options that were not given as flags from the config file
+	if *flagConfig != "" {
+		cfg, err := loadConfig(*flagConfig)
+		if err != nil {
+			return err
+		}
+		if err := cfg.apply(); err != nil {
+			return err
 		}
+	}
 
-		// Release the lock on the messages slice
-		mx.Unlock()
+	// Fill in the options that are still unset from the profile
+	if err := applyProfile(); err != nil {
+		return err
 	}
+
+	if err := setupLogger(); err != nil {
+		return err
+	}
+
+	if *flagProject == "" && *flagSource != sourceStdin {
+		return errors.New("must provide -project")
+	}
+
+	if *flagCredentialsFile != "" && *flagImpersonateServiceAccount != "" {
+		return errors.New("cannot use both -credentials-file and -impersonate-service-account")
+	}
+
+	switch *flagSource {
+	case sourcePubSub:
+		names := subscriptions()
+		if len(names) == 0 {
+			return errors.New("must provide -subscription")
+		}
+		seen := make(map[string]bool, len(names))
+		for _, name := range names {
+			if seen[name] {
+				return errors.New(fmt.Sprintf("subscription '%s' given more than once", name))
+			}
+			seen[name] = true
+		}
+	case sourceLogging:
+		if *flagPollInterval <= 0 {
+			return errors.New(fmt.Sprintf("poll interval '%s' must be > 0", *flagPollInterval))
+		}
+	case sourceStdin:
+	default:
+		return errors.New(fmt.Sprintf("unknown source '%s'", *flagSource))
+	}
+
+	if *flagBacklogOnly && *flagSource != sourcePubSub {
+		return errors.New("can only use -backlog-only with -source=pubsub")
+	}
+	if *flagBacklogExitAfter < 0 {
+		return errors.New(fmt.Sprintf("backlog exit delay '%s' must be >= 0", *flagBacklogExitAfter))
+	}
+
+	if *flagAdaptiveDrain && *flagSource != sourcePubSub {
+		return errors.New("can only use -adaptive-drain with -source=pubsub")
+	}
+	if *flagAdaptiveDrainBacklog < 0 {
+		return errors.New(fmt.Sprintf("adaptive drain backlog '%d' must be >= 0", *flagAdaptiveDrainBacklog))
+	}
+	if *flagAdaptiveDrainRoutines < 0 {
+		return errors.New(fmt.Sprintf("adaptive drain routines '%d' must be >= 0", *flagAdaptiveDrainRoutines))
+	}
+
+	*flagReceiveGoroutines = saneReceiveGoroutines(*flagReceiveGoroutines)
+
+	// Logged once clamped, so that it shows the values in use
+	if *flagProfile != "" {
+		logger.Info(
+			"profile",
+			"name", *flagProfile,
+			"flush_interval", flagFlushInterval.String(),
+			"buffer_size", *flagBufferSize,
+			"recv_routines", *flagReceiveGoroutines,
+			"max_outstanding_messages", *flagMaxOutstandingMessages,
+		)
+	}
+
+	if *flagMaxProcs < 1 {
+		return errors.New(fmt.Sprintf("max procs '%d' must be >= 1", *flagMaxProcs))
+	}
+	runtime.GOMAXPROCS(*flagMaxProcs)
+
+	if *flagGRPCConns < 1 {
+		return errors.New(fmt.Sprintf("gRPC connection pool size '%d' must be >= 1", *flagGRPCConns))
+	}
+
+	switch *flagOutput {
+	case outputStdout:
+	case outputUnixSocket:
+		if *flagSocketPath == "" {
+			return errors.New("must provide -socket-path with -output=unixsocket")
+		}
+	case outputHTTP:
+		if *flagHTTPURL == "" {
+			return errors.New("must provide -http-url with -output=http")
+		}
+	case outputFile:
+		if *flagOutputFile == "" {
+			return errors.New("must provide -output-file with -output=file")
+		}
+		if *flagOutputFileWindow < 0 {
+			return errors.New(fmt.Sprintf("output file window '%s' must be >= 0", *flagOutputFileWindow))
+		}
+		switch *flagOutputFileMode {
+		case fileModeAppend, fileModeTruncate:
+		default:
+			return errors.New(fmt.Sprintf("unknown output file mode '%s'", *flagOutputFileMode))
+		}
+		if *flagMinFreeBytes < 0 {
+			return errors.New(fmt.Sprintf("minimum free bytes '%d' must be >= 0", *flagMinFreeBytes))
+		}
+		if *flagGzip && *flagOutputFormat == outputFormatParquet {
+			return errors.New("cannot use -gzip with -output-format=parquet, which is compressed already")
+		}
+	case outputHoneycomb:
+		if *flagHoneycombWriteKey == "" {
+			return errors.New("must provide -honeycomb-writekey with -output=honeycomb")
+		}
+		if *flagHoneycombDataset == "" {
+			return errors.New("must provide -honeycomb-dataset with -output=honeycomb")
+		}
+		if u, err := url.Parse(*flagHoneycombAPIHost); err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.New(fmt.Sprintf("invalid Honeycomb API host '%s'", *flagHoneycombAPIHost))
+		}
+		if *flagFlushStats == flushStatsInline || *flagBatchMarker {
+			return errors.New("cannot use -flush-stats=output or -batch-marker with -output=honeycomb")
+		}
+	case outputGCS:
+		if *flagGCSBucket == "" {
+			return errors.New("must provide -gcs-bucket with -output=gcs")
+		}
+		if *flagGCSWindow <= 0 {
+			return errors.New(fmt.Sprintf("GCS window '%s' must be > 0", *flagGCSWindow))
+		}
+		switch *flagGCSCompression {
+		case gcsCompressionGzip, gcsCompressionNone:
+		default:
+			return errors.New(fmt.Sprintf("unknown GCS compression '%s'", *flagGCSCompression))
+		}
+	default:
+		return errors.New(fmt.Sprintf("unknown output '%s'", *flagOutput))
+	}
+	if *flagOutput == outputHTTP || *flagOutput == outputHoneycomb {
+		if *flagHTTPRetries < 0 {
+			return errors.New(fmt.Sprintf("HTTP retries '%d' must be >= 0", *flagHTTPRetries))
+		}
+		if *flagHTTPBatchSize < 0 {
+			return errors.New(fmt.Sprintf("HTTP batch size '%d' must be >= 0", *flagHTTPBatchSize))
+		}
+		if *flagHTTPBatchBytes < 0 {
+			return errors.New(fmt.Sprintf("HTTP batch bytes '%d' must be >= 0", *flagHTTPBatchBytes))
+		}
+	}
+	if *flagGzip && *flagOutput != outputFile {
+		return errors.New("can only use -gzip with -output=file")
+	}
+
+	if *flagRetryBackoffBase <= 0 {
+		return errors.New(fmt.Sprintf("retry backoff base '%s' must be > 0", *flagRetryBackoffBase))
+	}
+	if *flagRetryBackoffMax < *flagRetryBackoffBase {
+		return errors.New(fmt.Sprintf("retry backoff max '%s' must be >= the retry backoff base '%s'", *flagRetryBackoffMax, *flagRetryBackoffBase))
+	}
+	if *flagRetryBackoffMultiplier < 1 {
+		return errors.New(fmt.Sprintf("retry backoff multiplier '%g' must be >= 1", *flagRetryBackoffMultiplier))
+	}
+	switch *flagRetryJitter {
+	case retryJitterFull, retryJitterEqual, retryJitterNone:
+	default:
+		return errors.New(fmt.Sprintf("unknown retry jitter '%s'", *flagRetryJitter))
+	}
+
+	switch *flagOnOutputError {
+	case outputErrorExit, outputErrorDrop, outputErrorRetry:
+	default:
+		return errors.New(fmt.Sprintf("unknown output error policy '%s'", *flagOnOutputError))
+	}
+
+	if *flagOutputFormat == outputFormatJSON {
+		*flagOutputFormat = outputFormatNDJSON
+	}
+	switch *flagOutputFormat {
+	case outputFormatText, outputFormatNDJSON, outputFormatJSONArray:
+	case outputFormatParquet:
+		if *flagOutput != outputFile {
+			return errors.New("can only use -output-format=parquet with -output=file")
+		}
+	default:
+		return errors.New(fmt.Sprintf("unknown output format '%s'", *flagOutputFormat))
+	}
+	if *flagFlushStats == flushStatsInline && *flagOutputFormat != outputFormatNDJSON {
+		return errors.New("can only use -flush-stats=output with -output-format=ndjson")
+	}
+	if *flagBatchMarker && *flagOutputFormat != outputFormatNDJSON {
+		return errors.New("can only use -batch-marker with -output-format=ndjson")
+	}
+	if *flagParseCSVLog && *flagOutputFormat != outputFormatNDJSON && *flagOutputFormat != outputFormatJSONArray && *flagOutput != outputHoneycomb {
+		return errors.New("can only use -parse-csvlog with -output-format=ndjson or -output-format=json-array")
+	}
+	if *flagParsePGAudit && *flagOutputFormat != outputFormatNDJSON && *flagOutputFormat != outputFormatJSONArray && *flagOutput != outputHoneycomb {
+		return errors.New("can only use -parse-pgaudit with -output-format=ndjson or -output-format=json-array")
+	}
+	if *flagParsePGPrefix && *flagOutputFormat != outputFormatNDJSON && *flagOutputFormat != outputFormatJSONArray && *flagOutput != outputHoneycomb {
+		return errors.New("can only use -parse-pg-prefix with -output-format=ndjson or -output-format=json-array")
+	}
+	if *flagParseEmbeddedJSON && *flagOutputFormat != outputFormatNDJSON && *flagOutputFormat != outputFormatJSONArray && *flagOutput != outputHoneycomb {
+		return errors.New("can only use -parse-embedded-json with -output-format=ndjson or -output-format=json-array")
+	}
+
+	switch *flagColor {
+	case colorAuto, colorAlways, colorNever:
+	default:
+		return errors.New(fmt.Sprintf("unknown color mode '%s'", *flagColor))
+	}
+
+	switch *flagLineEnding {
+	case lineEndingLF:
+		lineEnding = "\n"
+	case lineEndingCRLF:
+		lineEnding = "\r\n"
+	default:
+		return errors.New(fmt.Sprintf("unknown line ending '%s'", *flagLineEnding))
+	}
+
+	if *flagTemplate != "" {
+		if *flagOutputFormat != outputFormatText {
+			return errors.New("can only use -template with -output-format=text")
+		}
+
+		// Try it out on an empty message, to also catch unknown fields
+		t, err := template.New("line").Parse(*flagTemplate)
+		if err == nil {
+			err = t.Execute(io.Discard, &messages.ParsedMessage{})
+		}
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid template '%s': %s", *flagTemplate, err.Error()))
+		}
+		lineTemplate = t
+	}
+
+	var ok bool
+	if inputEncoding, ok = parseInputEncoding(*flagInputEncoding); !ok {
+		return errors.New(fmt.Sprintf("unknown input encoding '%s'", *flagInputEncoding))
+	}
+
+	switch *flagInvalidUTF8 {
+	case invalidUTF8Repair, invalidUTF8Drop, invalidUTF8Keep:
+	default:
+		return errors.New(fmt.Sprintf("unknown invalid UTF-8 handling '%s'", *flagInvalidUTF8))
+	}
+
+	if err := compileReloadable(); err != nil {
+		return err
+	}
+
+	if err := compileProcessors(); err != nil {
+		return err
+	}
+
+	if err := compileSessionPattern(); err != nil {
+		return err
+	}
+
+	if err := compilePGPrefixPattern(); err != nil {
+		return err
+	}
+
+	if *flagBufferSize < 0 {
+		return errors.New(fmt.Sprintf("buffer size '%d' must be >= 0", *flagBufferSize))
+	}
+
+	if *flagBufferBytes < 0 {
+		return errors.New(fmt.Sprintf("buffer bytes '%d' must be >= 0", *flagBufferBytes))
+	}
+	if *flagBufferSize > 0 && *flagBufferBytes > 0 {
+		return errors.New("cannot use both -buffer-size and -buffer-bytes")
+	}
+
+	switch *flagOverflowPolicy {
+	case overflowBlock, overflowAck, overflowNack:
+	default:
+		return errors.New(fmt.Sprintf("unknown overflow policy '%s'", *flagOverflowPolicy))
+	}
+
+	if *flagFlushOnSeverity != "" {
+		level, ok := messages.SeverityLevel(*flagFlushOnSeverity)
+		if !ok {
+			return errors.New(fmt.Sprintf("unknown flush severity '%s'", *flagFlushOnSeverity))
+		}
+		flushSeverity = level
+	}
+
+	if time.Unix(0, 0).Format(*flagTimestampFormat) == *flagTimestampFormat {
+		return errors.New(fmt.Sprintf("timestamp format '%s' must be a Go time layout", *flagTimestampFormat))
+	}
+	loc, err := time.LoadLocation(*flagTimezone)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unknown timezone '%s': %s", *flagTimezone, err.Error()))
+	}
+	timestampLocation = loc
+
+	if *flagMaxLinesPerSecond < 0 {
+		return errors.New(fmt.Sprintf("max lines per second '%d' must be >= 0", *flagMaxLinesPerSecond))
+	}
+
+	if *flagMaxAge < 0 {
+		return errors.New(fmt.Sprintf("max age '%s' must be >= 0", *flagMaxAge))
+	}
+
+	if *flagMinSeverity != "" {
+		level, ok := messages.SeverityLevel(*flagMinSeverity)
+		if !ok {
+			return errors.New(fmt.Sprintf("unknown minimum severity '%s'", *flagMinSeverity))
+		}
+		minSeverity = level
+	}
+
+	if *flagFlushCount < 0 {
+		return errors.New(fmt.Sprintf("flush count '%d' must be >= 0", *flagFlushCount))
+	}
+	if *flagBufferSize > 0 && *flagFlushCount > *flagBufferSize {
+		return errors.New(fmt.Sprintf("flush count '%d' must not be above the buffer size '%d'", *flagFlushCount, *flagBufferSize))
+	}
+
+	if *flagMaxBuffer < 0 {
+		return errors.New(fmt.Sprintf("max buffer '%d' must be >= 0", *flagMaxBuffer))
+	}
+	if *flagBufferSize > 0 && *flagMaxBuffer > *flagBufferSize {
+		return errors.New(fmt.Sprintf("max buffer '%d' must not be above the buffer size '%d'", *flagMaxBuffer, *flagBufferSize))
+	}
+
+	if *flagForceFlushBytes < 0 {
+		return errors.New(fmt.Sprintf("force flush bytes '%d' must be >= 0", *flagForceFlushBytes))
+	}
+
+	if *flagMaxMessageBytes < 0 {
+		return errors.New(fmt.Sprintf("max message bytes '%d' must be >= 0", *flagMaxMessageBytes))
+	}
+	switch *flagOversizedPolicy {
+	case overflowAck, overflowNack:
+	default:
+		return errors.New(fmt.Sprintf("unknown oversized message policy '%s'", *flagOversizedPolicy))
+	}
+
+	switch *flagInvalidPolicy {
+	case overflowAck:
+	case overflowNack:
+		if *flagEmitRawOnError {
+			return errors.New("cannot use -emit-raw-on-error with -invalid-policy=nack")
+		}
+	default:
+		return errors.New(fmt.Sprintf("unknown invalid message policy '%s'", *flagInvalidPolicy))
+	}
+
+	switch *flagPanicPolicy {
+	case overflowAck, overflowNack:
+	default:
+		return errors.New(fmt.Sprintf("unknown panic policy '%s'", *flagPanicPolicy))
+	}
+
+	if *flagHighWaterMark < 0 || *flagLowWaterMark < 0 {
+		return errors.New("water marks must be >= 0")
+	}
+	if *flagLowWaterMark > *flagHighWaterMark {
+		return errors.New(fmt.Sprintf(
+			"low-water mark '%d' must not be above the high-water mark '%d'", *flagLowWaterMark, *flagHighWaterMark,
+		))
+	}
+
+	switch *flagSortStrategy {
+	case sortSlice, sortHeap:
+	default:
+		return errors.New(fmt.Sprintf("unknown sort strategy '%s'", *flagSortStrategy))
+	}
+
+	switch *flagSortBy {
+	case sortByCloudTimestamp, sortByLineTimestamp:
+	default:
+		return errors.New(fmt.Sprintf("unknown sort timestamp '%s'", *flagSortBy))
+	}
+
+	switch *flagSortOrder {
+	case sortAsc, sortDesc:
+	default:
+		return errors.New(fmt.Sprintf("unknown sort order '%s'", *flagSortOrder))
+	}
+
+	if *flagLateness < 0 {
+		return errors.New(fmt.Sprintf("lateness '%s' must be >= 0", *flagLateness))
+	}
+	if *flagInitialFlushDelay < 0 {
+		return errors.New(fmt.Sprintf("initial flush delay '%s' must be >= 0", *flagInitialFlushDelay))
+	}
+	if *flagWALMaxSize < 0 {
+		return errors.New(fmt.Sprintf("write-ahead log max size '%d' must be >= 0", *flagWALMaxSize))
+	}
+	if *flagMaxFutureSkew < 0 {
+		return errors.New(fmt.Sprintf("max future skew '%s' must be >= 0", *flagMaxFutureSkew))
+	}
+	if *flagMaxMessageResidence < 0 {
+		return errors.New(fmt.Sprintf("max message residence '%s' must be >= 0", *flagMaxMessageResidence))
+	}
+
+	if *flagFatalFlushTimeout < 0 {
+		return errors.New(fmt.Sprintf("fatal flush timeout '%s' must be >= 0", *flagFatalFlushTimeout))
+	}
+
+	if *flagMaxRuntime < 0 {
+		return errors.New(fmt.Sprintf("max runtime '%s' must be >= 0", *flagMaxRuntime))
+	}
+
+	if *flagIdleWarnAfter < 0 {
+		return errors.New(fmt.Sprintf("idle warning delay '%s' must be >= 0", *flagIdleWarnAfter))
+	}
+
+	if *flagGoroutineWatch < 0 {
+		return errors.New(fmt.Sprintf("goroutine watch interval '%s' must be >= 0", *flagGoroutineWatch))
+	}
+	if *flagGoroutineWatchFactor <= 1 {
+		return errors.New(fmt.Sprintf("goroutine watch factor '%g' must be > 1", *flagGoroutineWatchFactor))
+	}
+
+	if *flagReceiveRetries < 0 {
+		return errors.New(fmt.Sprintf("receive retries '%d' must be >= 0", *flagReceiveRetries))
+	}
+
+	if *flagLagResetThreshold < 0 {
+		return errors.New(fmt.Sprintf("lag reset threshold '%s' must be >= 0", *flagLagResetThreshold))
+	}
+
+	if *flagReadinessActivityTimeout < 0 {
+		return errors.New(fmt.Sprintf("readiness activity timeout '%s' must be >= 0", *flagReadinessActivityTimeout))
+	}
+
+	if *flagMetricsLogInterval < 0 {
+		return errors.New(fmt.Sprintf("metrics log interval '%s' must be >= 0", *flagMetricsLogInterval))
+	}
+
+	if *flagAddMessageID && *flagSource != sourcePubSub {
+		return errors.New("can only use -add-message-id with -source=pubsub")
+	}
+	if *flagAddSubscription && *flagSource != sourcePubSub {
+		return errors.New("can only use -add-subscription with -source=pubsub")
+	}
+
+	if *flagSequenceStateFile != "" && !*flagAddSequence {
+		return errors.New("cannot use -sequence-state-file without -add-sequence")
+	}
+
+	if *flagDedupeWindow < 0 {
+		return errors.New(fmt.Sprintf("dedupe window '%d' must be >= 0", *flagDedupeWindow))
+	}
+	if *flagDedupeWindow > 0 {
+		dedupeRecent = newRecentIDs(*flagDedupeWindow)
+	}
+	if *flagDedupeBloomCapacity == 0 {
+		return errors.New("dedupe filter capacity must be > 0")
+	}
+	if *flagDedupeBloomFPRate <= 0 || *flagDedupeBloomFPRate >= 1 {
+		return errors.New(fmt.Sprintf("dedupe filter false positive rate '%g' must be between 0 and 1", *flagDedupeBloomFPRate))
+	}
+	if *flagDedupeBloomInterval <= 0 {
+		return errors.New(fmt.Sprintf("dedupe filter interval '%s' must be > 0", *flagDedupeBloomInterval))
+	}
+
+	if *flagHTTPAddr == "" {
+		*flagNoHTTP = true
+	} else if _, port, err := net.SplitHostPort(*flagHTTPAddr); err != nil {
+		return errors.New(fmt.Sprintf("invalid HTTP address '%s': %s", *flagHTTPAddr, err.Error()))
+	} else if _, err := net.LookupPort("tcp", port); err != nil {
+		return errors.New(fmt.Sprintf("invalid HTTP address '%s': %s", *flagHTTPAddr, err.Error()))
+	}
+	if *flagNoHTTP && *flagDebugState {
+		return errors.New("cannot use -debug-state without the HTTP server")
+	}
+	if *flagNoHTTP && *flagLivenessFlushTimeout > 0 {
+		return errors.New("cannot use -liveness-flush-timeout without the HTTP server")
+	}
+	if *flagNoHTTP && *flagHTTPBearerToken != "" {
+		return errors.New("cannot use -http-bearer-token without the HTTP server")
+	}
+
+	if *flagHealthMaxConns < 1 {
+		return errors.New(fmt.Sprintf("health server max connections '%d' must be >= 1", *flagHealthMaxConns))
+	}
+
+	return checkFlushInterval(*flagFlushInterval)
+}
+
+// checkFlushInterval given by -flush-interval, which must be positive, warning
+// about those below one second
+func checkFlushInterval(d time.Duration) error {
+	if d <= 0 {
+		return errors.New(fmt.Sprintf("flush interval '%s' must be > 0", d))
+	} else if d < time.Second {
+		logger.Warn(fmt.Sprintf(
+			`Using a flush interval of "%s", below one second, may result in more out-of-order output.`,
+			d,
+		))
+	}
+
+	return nil
+}
+
+// serveHttpServer for liveliness/readiness check by GKE probe, and metrics
+func serveHttpServer() {
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// The client went away, which is no reason to stop tailing
+		_, err := fmt.Fprint(w, "Alive!")
+		if err != nil {
+			logger.Warn("could not return HTTP response", "path", r.URL.Path, "error", err)
+		}
+	})
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if wedged() {
+			http.Error(w, "No successful flush", http.StatusServiceUnavailable)
+			return
+		}
+		// The client went away, which is no reason to stop tailing
+		_, err := fmt.Fprint(w, "Alive!")
+		if err != nil {
+			logger.Warn("could not return HTTP response", "path", r.URL.Path, "error", err)
+		}
+	})
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if receivers.Load() < receiversWanted() {
+			http.Error(w, "Not receiving", http.StatusServiceUnavailable)
+			return
+		}
+		if inactive() {
+			http.Error(w, "No recent activity", http.StatusServiceUnavailable)
+			return
+		}
+		if diskLow.Load() {
+			http.Error(w, "Disk low", http.StatusServiceUnavailable)
+			return
+		}
+		// The client went away, which is no reason to stop tailing
+		_, err := fmt.Fprint(w, "Ready!")
+		if err != nil {
+			logger.Warn("could not return HTTP response", "path", r.URL.Path, "error", err)
+		}
+	})
+	http.HandleFunc("/pause", servePause(true))
+	http.HandleFunc("/resume", servePause(false))
+	http.HandleFunc("/status", serveStatus)
+	if *flagDebugState {
+		http.HandleFunc("/debug/state", serveDebugState)
+	}
+	if *flagHTTPBearerToken != "" {
+		httpServer.Handler = requireBearer(*flagHTTPBearerToken, http.DefaultServeMux)
+	}
+	l, err := net.Listen("tcp", *flagHTTPAddr)
+	if err != nil {
+		fatal(fmt.Errorf("could not start HTTP server: %w", err))
+	}
+	err = httpServer.Serve(netutil.LimitListener(l, *flagHealthMaxConns))
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal(fmt.Errorf("could not start HTTP server: %w", err))
+	}
+}
+
+// wedged reports whether messages have been received but no flush has
+// succeeded within -liveness-flush-timeout. Writes held back while the disk
+// is low do not count, as restarting would only lose the buffer.
+func wedged() bool {
+	if *flagLivenessFlushTimeout <= 0 || summaryReceived.Load() == 0 || diskLow.Load() {
+		return false
+	}
+
+	last := time.Unix(0, lastFlushSucceeded.Load())
+	if last.Before(startTime) {
+		last = startTime
+	}
+	return time.Since(last) > *flagLivenessFlushTimeout
+}
+
+// Set once a timestamp in the future was clamped, to only warn about it once
+var clampedWarned atomic.Bool
+
+// clampFutureTimestamp of a message to now, if it is further in the future
+// than -max-future-skew
+func clampFutureTimestamp(pm *messages.ParsedMessage) {
+	now := time.Now().UTC()
+	skew := pm.Timestamp.Sub(now)
+	if skew <= *flagMaxFutureSkew {
+		return
+	}
+
+	metricClampedTimestamps.Inc()
+	if clampedWarned.CompareAndSwap(false, true) {
+		logger.Warn("clamped a timestamp in the future, the clock of the source may be ahead", "timestamp", pm.Timestamp, "skew", skew.String())
+	} else {
+		logger.Debug("clamped a timestamp in the future", "timestamp", pm.Timestamp, "skew", skew.String())
+	}
+	pm.Timestamp = now
+}
+
+// Add a message that is received, by taking the given JSON data, parsing it
+// and appending the ParsedMessage to the messages slice. The message ID
+// identifies it in error records and is written with -add-message-id, the
+// ordering key is given when ordering is enforced, and the subscription it was
+// received from is written with -add-subscription. Reports whether the message
+// should be acknowledged.
+func (buf *Buffer) Add(data []byte, id, orderingKey, subscription string) bool {
+	var pm messages.ParsedMessage
+	summaryReceived.Add(1)
+	metricMessagesReceived.Inc()
+	noteReceived()
+
+	// Reject messages too large to hold before even parsing them
+	if *flagMaxMessageBytes > 0 && len(data) > *flagMaxMessageBytes {
+		metricMessagesOversized.Inc()
+		logger.Debug("rejected message over the size limit", "bytes", len(data))
+		reportError(stageSize, id, errors.New(fmt.Sprintf("message of %d bytes is over the %d bytes limit", len(data), *flagMaxMessageBytes)))
+		if *flagOversizedPolicy == overflowNack {
+			return false
+		}
+		summaryDropped.Add(1)
+		return true
+	}
+
+	// Reject messages that do not look like Cloud Logging entries
+	if *flagValidateSchema {
+		if reason := messages.Validate(data); reason != "" {
+			metricMessagesInvalid.WithLabelValues(reason).Inc()
+			logger.Debug("rejected message not matching the schema", "reason", reason)
+			reportError(stageSchema, id, errors.New(reason))
+			deadletter(data)
+			summaryInvalid.Add(1)
+			return true
+		}
+	}
+
+	// Parse the JSON data
+	raw := data
+	data = dropInvalidUTF8(data)
+	if err := json.Unmarshal(data, &pm); err != nil {
+		metricMessagesInvalid.WithLabelValues(messages.InvalidJSON).Inc()
+		summaryInvalid.Add(1)
+		reportError(stageParse, id, err)
+
+		// Leave it for redelivery if asked to, so that it reaches the
+		// dead-letter topic of the subscription
+		if *flagInvalidPolicy == overflowNack {
+			logger.Warn("nacked message that is not valid JSON", "subscription", subscription, "error", err)
+			return false
+		}
+
+		// Ignore it if it is erroneous, unless asked to pass it on as is
+		if !*flagEmitRawOnError {
+			logger.Warn("dropped message that is not valid JSON", "subscription", subscription, "error", err)
+			return true
+		}
+
+		logger.Debug("emitting raw message that is not valid JSON", "error", err)
+		pm = messages.ParsedMessage{TextPayload: rawPayloadPrefix + string(transcode(raw)), Timestamp: time.Now().UTC()}
+	} else {
+		transcodePayload(raw, &pm)
+	}
+
+	// Write structured entries as their JSON payload
+	pm.UseJSONPayload()
+
+	// Take the timestamp from the configured field instead, when it is present
+	if *flagTimestampField != "" {
+		parseTimestampField(data, &pm)
+	}
+
+	// Try the alternate schema if nothing useful was found in the standard one
+	if pm.Timestamp.IsZero() && pm.TextPayload == "" {
+		parseFallback(data, &pm)
+	}
+
+	// Bring timestamps from a clock running ahead back to now
+	if *flagMaxFutureSkew > 0 {
+		clampFutureTimestamp(&pm)
+	}
+
+	if *flagAddMessageID {
+		pm.MessageID = id
+	}
+	if *flagAddSubscription {
+		pm.Subscription = subscription
+	}
+	pm.OrderingKey = orderingKey
+
+	// Skip the entries of databases that are not allowed
+	if allowlist := databaseAllowlist.Load(); allowlist != nil && !(*allowlist)[pm.DatabaseID()] {
+		summaryDropped.Add(1)
+		skippedFiltered.Add(1)
+		logger.Debug("skipped message of a database not in the allowlist", "database_id", pm.DatabaseID())
+		return true
+	}
+
+	// Get a lock on the messages slice
+	buf.mx.Lock()
+	defer buf.mx.Unlock()
+
+	// Hold on to the message until the output recovers and while paused
+	for outputFailing || paused {
+		buf.intakeResumed.Wait()
+	}
+
+	// Apply the overflow policy if the buffer is full
+	for buf.full(len(pm.TextPayload)) {
+		switch *flagOverflowPolicy {
+		case overflowAck:
+			metricOverflowAcked.Inc()
+			summaryDropped.Add(1)
+			logger.Debug("dropped message received while the buffer is full")
+			return true
+		case overflowNack:
+			metricOverflowNacked.Inc()
+			logger.Debug("nacked message received while the buffer is full")
+			return false
+		default:
+			buf.bufferFreed.Wait()
+		}
+	}
+
+	// Drop a message that was already written, delivered again
+	if seenBefore(&pm) {
+		metricDuplicates.Inc()
+		summaryDropped.Add(1)
+		skippedDuplicate.Add(1)
+		logger.Debug("dropped message already written", "insert_id", pm.InsertID)
+		return true
+	}
+
+	// Add the new message to the slice, and to the write-ahead log so that it
+	// survives a restart
+	buf.insert(pm)
+	walAppend(&pm)
+	buf.bytes += len(pm.TextPayload)
+	updateThrottle(len(buf.msgs))
+
+	// Write out important messages right away
+	if *flagFlushOnSeverity != "" && pm.AtLeast(flushSeverity) {
+		select {
+		case forceFlush <- struct{}{}:
+			logger.Debug("buffered a message of the flush severity, flushing", "severity", pm.Severity)
+		default:
+		}
+	}
+
+	// Flush bursts as soon as enough has accumulated
+	if *flagFlushCount > 0 && len(buf.msgs) >= *flagFlushCount {
+		select {
+		case forceFlush <- struct{}{}:
+			logger.Debug("buffered the flush count, flushing", "messages", len(buf.msgs))
+		default:
+		}
+	}
+
+	// Relieve the pressure right away if the buffer grew past the ceiling
+	if *flagForceFlushBytes > 0 && buf.bytes > *flagForceFlushBytes {
+		select {
+		case forceFlush <- struct{}{}:
+			metricForcedFlushes.Inc()
+			logger.Warn("buffered bytes over the ceiling, forcing a flush", "bytes", buf.bytes, "ceiling", *flagForceFlushBytes)
+		default:
+		}
+	}
+	if *flagMaxBuffer > 0 && len(buf.msgs) >= *flagMaxBuffer {
+		select {
+		case forceFlush <- struct{}{}:
+			metricForcedFlushes.Inc()
+			logger.Warn("buffered messages at the ceiling, forcing a flush", "messages", len(buf.msgs), "ceiling", *flagMaxBuffer)
+		default:
+		}
+	}
+
+	return true
+}
+
+// full reports whether the messages slice has no room for another message
+// with a payload of the given size, according to -buffer-size or
+// -buffer-bytes, or at all while the disk of the file output is low on free
+// space. The lock on the messages slice must be held.
+func (buf *Buffer) full(size int) bool {
+	switch {
+	case diskLow.Load():
+		return len(buf.msgs) > 0
+	case *flagBufferSize > 0:
+		return len(buf.msgs) >= *flagBufferSize
+	case *flagBufferBytes > 0:
+		// Always let a message in when the buffer is empty, however large it is
+		return len(buf.msgs) > 0 && buf.bytes+size > *flagBufferBytes
+	default:
+		return false
+	}
+}
+
+// parseFallback fills in the text payload and timestamp of the given message
+// from the JSON paths configured by -fallback-text-path and -fallback-timestamp-path
+func parseFallback(data []byte, pm *messages.ParsedMessage) {
+	if *flagFallbackTextPath == "" && *flagFallbackTimestampPath == "" {
+		return
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return
+	}
+
+	if *flagFallbackTextPath != "" {
+		if text, ok := messages.LookupString(doc, *flagFallbackTextPath); ok {
+			pm.TextPayload = text
+		}
+	}
+
+	if *flagFallbackTimestampPath != "" {
+		if t, ok := lookupTimestamp(doc, *flagFallbackTimestampPath); ok {
+			pm.Timestamp = t
+		}
+	}
+}
+
+// parseTimestampField sets the timestamp of the given message from the JSON
+// path configured by -timestamp-field, if the message has that field
+func parseTimestampField(data []byte, pm *messages.ParsedMessage) {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return
+	}
+
+	if t, ok := lookupTimestamp(doc, *flagTimestampField); ok {
+		pm.Timestamp = t
+	}
+}
+
+// lookupTimestamp at the given dot-separated path, if it holds an RFC 3339 timestamp
+func lookupTimestamp(doc interface{}, path string) (time.Time, bool) {
+	ts, ok := messages.LookupString(doc, path)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	return t, err == nil
+}
+
+// subscriptions given by -subscription
+func subscriptions() []string {
+	return splitList(*flagSubscription)
+}
+
+// receiversWanted for the source to be ready, one per subscription with Pub/Sub
+func receiversWanted() int32 {
+	if *flagSource == sourcePubSub {
+		return int32(len(subscriptions()))
+	}
+	return 1
+}
+
+// receivePubSub messages from each of the subscriptions until the context is
+// done, into the same buffer. Once receiving from one of them fails for good,
+// the others are stopped too.
+func receivePubSub(ctx context.Context) error {
+	names := subscriptions()
+	if len(names) == 1 {
+		return receiveFrom(ctx, names[0])
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Failures are sent before cancelling, to be received ahead of the
+	// cancellations they cause
+	errs := make(chan error, len(names))
+	for _, name := range names {
+		go func(name string) {
+			err := receiveFrom(ctx, name)
+			errs <- err
+			if err != nil {
+				cancel()
+			}
+		}(name)
+	}
+
+	var first error
+	for range names {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// receiveFrom the subscription until the context is done, recreating the
+// client whenever it lags for longer than -lag-reset-threshold, once
+// -adaptive-drain is done draining the backlog, and after receiving fails up
+// to -receive-retries times in a row
+func receiveFrom(ctx context.Context, name string) error {
+	failures := 0
+	routines := *flagReceiveGoroutines
+	var watchBacklog func(context.Context, func())
+	if *flagAdaptiveDrain {
+		routines, watchBacklog = adaptiveDrain(ctx, name)
+	}
+
+	// Publish time of the most recent message received from the subscription,
+	// in Unix nanoseconds
+	var published atomic.Int64
+
+	for {
+		recvCtx, cancel := context.WithCancel(ctx)
+		var lagged, settled atomic.Bool
+		if *flagLagResetThreshold > 0 {
+			go watchLag(recvCtx, name, &published, *flagLagResetThreshold, time.Now(), func() {
+				lagged.Store(true)
+				cancel()
+			})
+		}
+		if watchBacklog != nil {
+			go watchBacklog(recvCtx, func() {
+				settled.Store(true)
+				cancel()
+			})
+		}
+
+		received := summaryReceived.Load()
+		err := receiveSubscription(recvCtx, name, &published, routines)
+		cancel()
+		if ctx.Err() != nil {
+			return err
+		}
+
+		switch {
+		case settled.Load():
+			// Carry on with the configured number of goroutines
+			routines, watchBacklog = *flagReceiveGoroutines, nil
+		case lagged.Load():
+			// Write out what was received before starting over
+			metricClientResets.Inc()
+			buffer.Flush(false)
+		case err == nil:
+			return nil
+		default:
+			// Only give up on failures in a row
+			if summaryReceived.Load() > received {
+				failures = 0
+			}
+			failures++
+			if failures > *flagReceiveRetries {
+				return err
+			}
+
+			backoff := retryBackoff(failures)
+			logger.Warn("receiving failed, retrying", "subscription", name, "attempt", failures, "backoff", backoff.String(), "error", err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+		}
+	}
+}
+
+// receiveSubscription messages with a new Pub/Sub client, using the given
+// number of goroutines, until the context is done, noting the most recent
+// publish time in published
+func receiveSubscription(ctx context.Context, name string, published *atomic.Int64, routines int) error {
+	// Create the subscription to Pub/Sub
+	c, sub, err := subscribeToPubSub(ctx, name, routines)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Make sure the subscription is set up for us to be its only consumer
+	ordered, err := checkSubscription(ctx, sub)
+	if err != nil {
+		return err
+	}
+
+	// Stop receiving once the backlog has been processed, if asked to
+	stopCtx := ctx
+	if *flagBacklogOnly && *flagBacklogExitAfter > 0 {
+		var cancel context.CancelFunc
+		stopCtx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		go stopWhenCaughtUp(stopCtx, cancel)
+	}
+
+	// Ready from here until the client is recreated
+	receivers.Add(1)
+	defer receivers.Add(-1)
+
+	err = sub.Receive(stopCtx, func(ctx context.Context, msg *pubsub.Message) {
+		defer admit()()
+		defer recoverMessage(msg)
+
+		// Leave the messages published since we started for later
+		if *flagBacklogOnly && !inBacklog(msg) {
+			msg.Nack()
+			return
+		}
+
+		notePublished(published, msg.PublishTime)
+
+		// Parse the received message, and acknowledge that it was received
+		// unless it should be redelivered
+		key := ""
+		if ordered {
+			key = msg.OrderingKey
+		}
+		if buffer.Add(msg.Data, msg.ID, key, name) {
+			msg.Ack()
+		} else {
+			msg.Nack()
+		}
+	})
+	if err != nil && ctx.Err() == nil && isCancellation(stopCtx, err) {
+		return nil
+	}
+
+	return err
+}
+
+// checkAckDeadline against how long messages may wait unacknowledged, which
+// is while intake is held back for a flush to make room for them: at most one
+// flush interval plus the time to write it. The client extends the ack
+// deadline of waiting messages up to its max extension, so that is the limit
+// that matters, unless extending is disabled.
+func checkAckDeadline(sub *pubsub.Subscription, ackDeadline time.Duration) error {
+	wait := *flagFlushInterval
+	if *flagOutput == outputHTTP || *flagOutput == outputHoneycomb {
+		wait += time.Duration(*flagHTTPRetries+1)*httpOutputTimeout + retryBackoffTotal(*flagHTTPRetries)
+	}
+
+	limit, name := sub.ReceiveSettings.MaxExtension, "max extension"
+	if limit == 0 {
+		limit = pubsub.DefaultReceiveSettings.MaxExtension
+	}
+	if limit < 0 {
+		limit, name = ackDeadline, "ack deadline"
+	}
+
+	logger.Debug("checked ack deadline", "wait", wait.String(), "ack_deadline", ackDeadline.String(), "limit", limit.String())
+	if wait < limit {
+		return nil
+	}
+
+	problem := fmt.Sprintf("flush interval plus output latency of %s is not shorter than the %s of %s, so messages waiting for a flush may be redelivered", wait, name, limit)
+	if *flagStrictConfig {
+		return errors.New(fmt.Sprintf("subscription '%s': %s", sub.ID(), problem))
+	}
+
+	logger.Warn(problem, "subscription", sub.ID())
+	return nil
+}
+
+// recoverMessage from a panic while handling it, so that a single bad
+// message cannot take the process down, acknowledging it or not depending on
+// -panic-policy
+func recoverMessage(msg *pubsub.Message) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	metricPanicsRecovered.Inc()
+	logger.Error("recovered from a panic handling a message", "panic", fmt.Sprint(r), "message_id", msg.ID, "bytes", len(msg.Data))
+	if *flagPanicPolicy == overflowNack {
+		msg.Nack()
+	} else {
+		msg.Ack()
+	}
+}
+
+// subscribeToPubSub subscription in order to receive messages from logs
+func subscribeToPubSub(ctx context.Context, name string, routines int) (*pubsub.Client, *pubsub.Subscription, error) {
+	// Create a new Pub/Sub client for the given GCP project
+	opts := append(credentialOptions(), option.WithGRPCConnectionPool(*flagGRPCConns))
+	if *flagEmulatorHost != "" {
+		// The emulator takes neither credentials nor TLS
+		conn, err := grpc.DialContext(ctx, *flagEmulatorHost, grpc.WithInsecure())
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = []option.ClientOption{option.WithGRPCConn(conn), option.WithoutAuthentication()}
+	}
+	c, err := pubsub.NewClient(ctx, *flagProject, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Subscribe into the given Pub/Sub subscription
+	sub := c.Subscription(name)
+	sub.ReceiveSettings.NumGoroutines = routines
+	sub.ReceiveSettings.MaxOutstandingMessages = outstandingLimit(*flagMaxOutstandingMessages)
+	sub.ReceiveSettings.MaxOutstandingBytes = outstandingLimit(*flagMaxOutstandingBytes)
+
+	return c, sub, nil
+}
+
+// saneReceiveGoroutines for -recv-routines, the Pub/Sub client default when
+// below 1 and at most maxReceiveGoroutines, warning when it had to be changed
+func saneReceiveGoroutines(n int) int {
+	switch {
+	case n < 1:
+		logger.Warn(fmt.Sprintf(
+			`Cannot have "%d" routines. Using default value of "%d"!`,
+			n, pubsub.DefaultReceiveSettings.NumGoroutines,
+		))
+		return pubsub.DefaultReceiveSettings.NumGoroutines
+	case n > maxReceiveGoroutines:
+		logger.Warn(fmt.Sprintf(
+			`Cannot have "%d" routines. Using the maximum of "%d"!`,
+			n, maxReceiveGoroutines,
+		))
+		return maxReceiveGoroutines
+	}
+	return n
+}
+
+// outstandingLimit for the receive settings, where the client takes a
+// negative value, rather than 0, to mean no limit
+func outstandingLimit(n int) int {
+	if n <= 0 {
+		return -1
+	}
+	return n
+}
+
+// checkSubscription configuration, logging it so that operators can spot a
+// subscription that is accidentally shared, and refusing to use one that
+// cannot be ours alone when -exclusive is set. Reports whether the delivery
+// order of its messages sharing an ordering key is to be preserved, with
+// -enforce-ordering on an ordering-enabled subscription.
+func checkSubscription(ctx context.Context, sub *pubsub.Subscription) (bool, error) {
+	// Assume the subscription orders its messages until told otherwise
+	ordered := *flagEnforceOrdering
+
+	cfg, err := sub.Config(ctx)
+	if err != nil {
+		if *flagExclusive {
+			return false, errors.New(fmt.Sprintf("could not read the configuration of subscription '%s': %s", sub.ID(), err.Error()))
+		}
+
+		logger.Warn("could not read the subscription configuration", "subscription", sub.ID(), "error", err)
+		return ordered, nil
+	}
+
+	logger.Info(
+		"subscription configuration",
+		"subscription", sub.ID(),
+		"topic", cfg.Topic.ID(),
+		"ack_deadline", cfg.AckDeadline,
+		"retention", cfg.RetentionDuration,
+		"message_ordering", cfg.EnableMessageOrdering,
+		"filter", cfg.Filter,
+		"push_endpoint", cfg.PushConfig.Endpoint,
+	)
+
+	if *flagEnforceOrdering && !cfg.EnableMessageOrdering {
+		logger.Warn("subscription does not have message ordering enabled, not enforcing it", "subscription", sub.ID())
+		ordered = false
+	}
+
+	if err := checkAckDeadline(sub, cfg.AckDeadline); err != nil {
+		return false, err
+	}
+
+	var problem string
+	switch {
+	case cfg.Detached:
+		problem = "is detached from its topic"
+	case cfg.PushConfig.Endpoint != "":
+		problem = fmt.Sprintf("pushes its messages to '%s'", cfg.PushConfig.Endpoint)
+	default:
+		return ordered, nil
+	}
+
+	if *flagExclusive {
+		return false, errors.New(fmt.Sprintf("subscription '%s' %s", sub.ID(), problem))
+	}
+
+	logger.Warn(fmt.Sprintf("subscription %s, messages may not reach us", problem), "subscription", sub.ID())
+	return ordered, nil
+}
+
+// flushMessages will flush the message slice on every tick, until the context
+// is done
+func (buf *Buffer) flushMessages(ctx context.Context, d, initialDelay time.Duration) {
+	// Hold the first flush back for the initial delay too, relieving the
+	// buffer in the meantime if it needs it
+	first := time.NewTimer(d + initialDelay)
+	defer first.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-ctx.Done():
+			return
+		case <-first.C:
+			waiting = false
+		case <-forceFlush:
+			buf.Flush(false)
+		}
+	}
+	buf.Flush(false)
+
+	// Create a ticker for that helps us wait 'dur' to flush
+	tick := time.NewTicker(d)
+	defer tick.Stop()
+
+	for {
+		// Wait for the next tick, or for the buffer to need relief
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		case <-forceFlush:
+		}
+
+		buf.Flush(false)
+	}
+}
+
+// Flush the messages slice to the output, ordered by timestamp. When drain is
+// set this is the last flush before exiting.
+func (buf *Buffer) Flush(drain bool) {
+	buf.flushAtMost(drain, 0)
+}
+
+// flushAtMost the given number of messages, the oldest ones, or all of them if
+// it is 0. When drain is set this is one of the last flushes before exiting.
+func (buf *Buffer) flushAtMost(drain bool, limit int) {
+	// Get a lock on the messages slice
+	buf.mx.Lock()
+	defer buf.mx.Unlock()
+	start := time.Now()
+
+	// Keep the messages for a later flush while the disk is low, unless
+	// exiting, when there is no later flush
+	if fw, ok := buf.out.(*fileWriter); ok && fw.lowOnSpace() && !drain {
+		logger.Debug("free disk space below the minimum, leaving the messages for the next flush")
+		return
+	}
+
+	// Hold back the messages newer than the watermark, in case older ones are
+	// still on their way
+	var watermark time.Time
+	if *flagLateness > 0 && !drain {
+		watermark = time.Now().Add(-*flagLateness)
+	}
+
+	// Unless a message has been held back for too long already
+	if *flagMaxMessageResidence > 0 && !watermark.IsZero() && buf.overdue(time.Now().Add(-*flagMaxMessageResidence)) {
+		logger.Debug("flushing every message, as one has been buffered for too long")
+		watermark = time.Time{}
+	}
+
+	// Leave what is over the rate limit for the following flushes, unless
+	// exiting
+	if *flagMaxLinesPerSecond > 0 && !drain {
+		allowed := lineAllowance()
+		if allowed < 1 {
+			logger.Debug("rate limit reached, leaving the messages for the next flush")
+			return
+		}
+		if limit == 0 || allowed < limit {
+			limit = allowed
+		}
+	}
+	b := batch{msgs: buf.takeFlushable(watermark, limit), lateBefore: buf.lastWatermark, drain: drain}
+
+	// Leave whatever is past the cap on the number of events behind
+	if *flagMaxEvents > 0 {
+		left := *flagMaxEvents - summaryFlushed.Load()
+		if uint64(len(b.msgs)) > left {
+			buf.restore(append([]messages.ParsedMessage(nil), b.msgs[left:]...))
+			b.msgs = b.msgs[:left]
+		}
+	}
+
+	// If no messages available, there may still be a heartbeat due
+	if len(b.msgs) == 0 && !drain {
+		if *flagHeartbeatInterval > 0 && time.Since(buf.lastFlush) >= *flagHeartbeatInterval {
+			// Let downstream know that we are alive, even though there is nothing to say
+			heartbeat := messages.ParsedMessage{TextPayload: heartbeatPayload, Timestamp: time.Now().UTC()}
+			err := writeMessages(buf.out, batch{msgs: []messages.ParsedMessage{heartbeat}})
+			if !buf.outputWritten(err, false) {
+				return
+			}
+
+			buf.lastFlush = heartbeat.Timestamp
+			buf.lastWriteDropped = err != nil
+		}
+
+		// Nothing waiting to be written cannot be stuck behind the output,
+		// unless it failed the last time it was written to
+		if len(buf.msgs) == 0 && !buf.lastWriteDropped {
+			lastFlushSucceeded.Store(time.Now().UnixNano())
+		}
+		logFlushSummary(nil, true)
+		return
+	}
+
+	b.msgs = dropRecentDuplicates(b.msgs)
+	if sessionPattern != nil {
+		groupBySession(b.msgs)
+	}
+	if *flagCoalesceOperations {
+		b.msgs = coalesceOperations(b.msgs)
+	}
+	if *flagCoalesceContinuations {
+		var held []messages.ParsedMessage
+		b.msgs, held = coalesceContinuations(b.msgs, drain, buf.lastFlush)
+		buf.restore(held)
+	}
+	if *flagSortOrder == sortDesc {
+		reverse(b.msgs)
+	}
+	var oldest time.Time
+	if *flagMaxAge > 0 {
+		oldest = time.Now().Add(-*flagMaxAge)
+	}
+	kept := b.msgs[:0]
+	for i := range b.msgs {
+		// Messages without a timestamp were not parsed right, rather than old
+		if !oldest.IsZero() && !b.msgs[i].Timestamp.IsZero() && b.msgs[i].Timestamp.Before(oldest) {
+			metricMessagesExpired.Inc()
+			summaryDropped.Add(1)
+			skippedExpired.Add(1)
+			logger.Debug("dropped message older than the max age", "timestamp", b.msgs[i].Timestamp)
+			continue
+		}
+		if *flagMinSeverity != "" && b.msgs[i].Below(minSeverity) {
+			summaryDropped.Add(1)
+			skippedSeverity.Add(1)
+			logger.Debug("dropped message below the minimum severity", "severity", b.msgs[i].Severity)
+			continue
+		}
+		transform(&b.msgs[i])
+		if msg, ok := process(&b.msgs[i]); ok {
+			kept = append(kept, *msg)
+		} else {
+			summaryDropped.Add(1)
+			skippedFiltered.Add(1)
+			logger.Debug("dropped message in a processor")
+		}
+	}
+	b.msgs = kept
+	sequenced := assignSequence(b.msgs)
+
+	// Write out all messages, keeping them for the next flush if asked to retry
+	err := writeMessages(buf.out, b)
+	written := len(b.msgs)
+	if err != nil {
+		reportError(stageOutput, "", errors.New(fmt.Sprintf("could not write %d messages: %s", len(b.msgs), err.Error())))
+		written = writtenBefore(err)
+	}
+	if !buf.outputWritten(err, drain) {
+		// Of a batch sent in several requests, only those that failed are
+		// sent again
+		commitSequence(sequencedIn(b.msgs[:written]))
+		if *flagMaxLinesPerSecond > 0 {
+			spendLines(written)
+		}
+		countFlushed(b.msgs[:written])
+		noteWritten(b.msgs[:written])
+		buf.restore(b.msgs[written:])
+		return
+	}
+	commitSequence(sequenced)
+	if *flagMaxLinesPerSecond > 0 {
+		spendLines(len(b.msgs))
+	}
+	summaryDropped.Add(uint64(len(b.msgs) - written))
+	countFlushed(b.msgs[:written])
+	logFlushSummary(b.msgs, err == nil)
+
+	if watermark.After(buf.lastWatermark) {
+		buf.lastWatermark = watermark
+	}
+
+	if err == nil {
+		writeFlushStats(b, time.Since(start))
+	}
+	noteWritten(b.msgs[:written])
+
+	// The written messages no longer need to survive a restart
+	compactWAL(buf.msgs)
+
+	buf.bytes = 0
+	for i := range buf.msgs {
+		buf.bytes += len(buf.msgs[i].TextPayload)
+	}
+	updateThrottle(len(buf.msgs))
+	buf.bufferFreed.Broadcast()
+
+	buf.lastFlush = time.Now()
+	buf.lastFlushDuration = buf.lastFlush.Sub(start)
+	buf.lastWriteDropped = err != nil
+	if err == nil {
+		lastFlushSucceeded.Store(buf.lastFlush.UnixNano())
+	}
+	noteActivity()
+}
+
+// countFlushed messages that were written, stopping once -max-events is
+// reached
+func countFlushed(msgs []messages.ParsedMessage) {
+	if len(msgs) == 0 {
+		return
+	}
+
+	metricMessagesFlushed.Add(float64(len(msgs)))
+	if flushed := summaryFlushed.Add(uint64(len(msgs))); *flagMaxEvents > 0 && flushed >= *flagMaxEvents {
+		logger.Info("flushed the maximum number of events, stopping", "max_events", *flagMaxEvents)
+		stopReceiving()
+	}
+}
+
+// outputWritten applies the output error policy to the result of writing a
+// batch, reporting whether the batch is done with and can be discarded. The
+// lock on the messages slice must be held.
+func (buf *Buffer) outputWritten(err error, drain bool) bool {
+	if err == nil {
+		if outputFailing {
+			logger.Info("writing output recovered, resuming")
+			outputFailing = false
+			buf.intakeResumed.Broadcast()
+		}
+
+		return true
+	}
+
+	logger.Error("could not write output", "error", err)
+
+	switch *flagOnOutputError {
+	case outputErrorExit:
+		// Not through fatal, there is no point in flushing to the broken output
+		os.Exit(1)
+	case outputErrorRetry:
+		// There is no later flush to retry in when draining
+		if !drain {
+			outputFailing = true
+			return false
+		}
+	}
+
+	return true
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// setFlag to the value for a test or benchmark, restoring its previous value
+// after it
+func setFlag(t testing.TB, name, value string) {
+	t.Helper()
+	f := flag.Lookup(name)
+	if f == nil {
+		t.Fatalf("no flag -%s", name)
+	}
+
+	previous := f.Value.String()
+	if err := f.Value.Set(value); err != nil {
+		t.Fatalf("could not set -%s=%s: %s", name, value, err)
+	}
+	t.Cleanup(func() { _ = f.Value.Set(previous) })
+}
+
+// captureLogs of the logger during a test
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var logs bytes.Buffer
+	previous := logger
+	logger = slog.New(slog.NewTextHandler(&logs, nil))
+	t.Cleanup(func() { logger = previous })
+	return &logs
+}
+
+func TestCheckFlushInterval(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		valid    bool
+		warned   bool
+	}{
+		{interval: 0, valid: false},
+		{interval: -time.Second, valid: false},
+		{interval: -time.Nanosecond, valid: false},
+		{interval: time.Nanosecond, valid: true, warned: true},
+		{interval: 500 * time.Millisecond, valid: true, warned: true},
+		{interval: time.Second, valid: true, warned: false},
+		{interval: 5 * time.Second, valid: true, warned: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.interval.String(), func(t *testing.T) {
+			logs := captureLogs(t)
+
+			err := checkFlushInterval(tt.interval)
+			if (err == nil) != tt.valid {
+				t.Errorf("got error %v, want valid %t", err, tt.valid)
+			}
+			if warned := strings.Contains(logs.String(), "below one second"); warned != tt.warned {
+				t.Errorf("got warning %t, want %t: %s", warned, tt.warned, logs.String())
+			}
+		})
+	}
+}
+
+func TestSaneReceiveGoroutines(t *testing.T) {
+	def := pubsub.DefaultReceiveSettings.NumGoroutines
+	tests := []struct {
+		n      int
+		want   int
+		warned bool
+	}{
+		{n: -1, want: def, warned: true},
+		{n: 0, want: def, warned: true},
+		{n: 1, want: 1},
+		{n: 16, want: 16},
+		{n: maxReceiveGoroutines, want: maxReceiveGoroutines},
+		{n: maxReceiveGoroutines + 1, want: maxReceiveGoroutines, warned: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.n), func(t *testing.T) {
+			logs := captureLogs(t)
+
+			if got := saneReceiveGoroutines(tt.n); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+			if warned := strings.Contains(logs.String(), "Cannot have"); warned != tt.warned {
+				t.Errorf("got warning %t, want %t: %s", warned, tt.warned, logs.String())
+			}
+		})
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	live := context.Background()
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want int
+	}{
+		{name: "stopped", ctx: live, err: nil, want: 0},
+		{name: "failed", ctx: live, err: errors.New("subscription not found"), want: 1},
+		{name: "cancelled while live", ctx: live, err: context.Canceled, want: 1},
+		{name: "cancelled receive", ctx: cancelled, err: context.Canceled, want: 0},
+		{name: "cancelled gRPC receive", ctx: cancelled, err: status.Error(codes.Canceled, "context canceled"), want: 0},
+		{name: "max runtime reached", ctx: expired, err: fmt.Errorf("receive: %w", context.DeadlineExceeded), want: 0},
+		{name: "failed while cancelled", ctx: cancelled, err: errors.New("permission denied"), want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.ctx, tt.err); got != tt.want {
+				t.Errorf("got exit code %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCancelledReceiveExitsCleanly(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	t.Cleanup(func() { os.Stdin = stdin })
+	buffer, _ = newTestBuffer(t)
+	t.Cleanup(func() { buffer = nil })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- readStdin(ctx) }()
+	cancel()
+
+	select {
+	case err := <-done:
+		if got := exitCode(ctx, err); got != 0 {
+			t.Errorf("got exit code %d for %v, want 0", got, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("receiving did not stop once cancelled")
+	}
+}
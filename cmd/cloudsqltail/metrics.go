@@ -0,0 +1,148 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Prefixes of the metrics of the Go runtime and the process, which are left
+// out of the logged metrics
+var runtimeMetricPrefixes = []string{"go_", "process_", "promhttp_"}
+
+// Metrics exposed on the /metrics endpoint of the HTTP server
+var (
+	metricMessagesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "messages_received_total",
+		Help: "Number of messages received from the source.",
+	})
+	metricMessagesFlushed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "messages_flushed_total",
+		Help: "Number of messages written to the output by flushes.",
+	})
+	metricBufferDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "buffer_depth",
+		Help: "Number of messages held in the buffer, as of the last message buffered or flush.",
+	})
+	metricMessagesInvalid = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "messages_invalid_total",
+		Help: "Number of received messages that are not valid JSON, or with -validate-schema do not conform to the Cloud Logging schema, by reason.",
+	}, []string{"reason"})
+	metricOverflowAcked = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "overflow_acked_total",
+		Help: "Number of messages dropped and acknowledged because the buffer was full.",
+	})
+	metricOverflowNacked = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "overflow_nacked_total",
+		Help: "Number of messages not acknowledged, for redelivery, because the buffer was full.",
+	})
+	metricReceiveThrottled = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "receive_throttled",
+		Help: "Whether message intake is throttled because the buffer is above its high-water mark (1) or not (0).",
+	})
+	metricOutOfOrder = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "out_of_order_total",
+		Help: "Number of adjacent pairs of messages that arrived out of timestamp order, with -count-out-of-order.",
+	})
+	metricSubscriptionIdle = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "subscription_idle",
+		Help: "Whether no message has been received for -idle-warn-after (1) or not (0).",
+	})
+	metricForcedFlushes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "forced_flushes_total",
+		Help: "Number of flushes forced because the buffered bytes grew past -force-flush-bytes, or the buffered messages reached -max-buffer.",
+	})
+	metricMessagesOversized = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "messages_oversized_total",
+		Help: "Number of received messages rejected for being larger than -max-message-bytes.",
+	})
+	metricClampedTimestamps = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "clamped_timestamps_total",
+		Help: "Number of timestamps further in the future than -max-future-skew replaced with the current time.",
+	})
+	metricDuplicates = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "duplicates_total",
+		Help: "Number of received messages dropped as their insert ID was written before, with -dedupe-window or -dedupe-bloom-path.",
+	})
+	metricMessagesExpired = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "messages_expired_total",
+		Help: "Number of messages dropped at flush for being older than -max-age.",
+	})
+	metricPanicsRecovered = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "panics_recovered_total",
+		Help: "Number of received messages whose handling panicked, and was recovered from.",
+	})
+	metricClientResets = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "client_resets_total",
+		Help: "Number of times the Pub/Sub client was recreated for lagging past -lag-reset-threshold.",
+	})
+)
+
+// logMetrics every interval, as a single log line with the values of the
+// counters and gauges, for environments that only have log-based metrics
+func logMetrics(d time.Duration) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		families, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			logger.Warn("could not gather metrics", "error", err)
+			continue
+		}
+
+		var attrs []any
+		for _, mf := range families {
+			if isRuntimeMetric(mf.GetName()) {
+				continue
+			}
+
+			for _, m := range mf.GetMetric() {
+				var value float64
+				switch mf.GetType() {
+				case dto.MetricType_COUNTER:
+					value = m.GetCounter().GetValue()
+				case dto.MetricType_GAUGE:
+					value = m.GetGauge().GetValue()
+				default:
+					continue
+				}
+				attrs = append(attrs, metricKey(mf.GetName(), m.GetLabel()), value)
+			}
+		}
+
+		logger.Info("metrics", attrs...)
+	}
+}
+
+// isRuntimeMetric reports whether the metric is one of the Go runtime or the
+// process rather than of cloudsqltail
+func isRuntimeMetric(name string) bool {
+	for _, prefix := range runtimeMetricPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// metricKey of a metric in the log line, its name followed by its labels in
+// the Prometheus notation, e.g. messages_invalid_total{reason="invalid_json"}
+func metricKey(name string, labels []*dto.LabelPair) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, l.GetName()+`="`+l.GetValue()+`"`)
+	}
+	sort.Strings(pairs)
+
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+
+	"cloudsqltail/messages"
+)
+
+// coalesceOperations of the sorted messages of a flush, merging the messages
+// of each operation into the first of them, with their payloads joined by
+// newlines in order. Messages that are not part of an operation are kept as
+// they are.
+func coalesceOperations(msgs []messages.ParsedMessage) []messages.ParsedMessage {
+	first := make(map[string]int)
+	payloads := make(map[int][]string)
+	coalesced := msgs[:0]
+	for _, msg := range msgs {
+		if msg.Operation == nil || msg.Operation.ID == "" {
+			coalesced = append(coalesced, msg)
+			continue
+		}
+
+		i, ok := first[msg.Operation.ID]
+		if !ok {
+			first[msg.Operation.ID] = len(coalesced)
+			payloads[len(coalesced)] = []string{msg.TextPayload}
+			op := *msg.Operation
+			msg.Operation = &op
+			coalesced = append(coalesced, msg)
+			continue
+		}
+
+		payloads[i] = append(payloads[i], msg.TextPayload)
+		if msg.Operation.Last {
+			coalesced[i].Operation.Last = true
+		}
+	}
+
+	for i, p := range payloads {
+		if len(p) > 1 {
+			coalesced[i].TextPayload = strings.Join(p, "\n")
+		}
+	}
+
+	return coalesced
+}
@@ -0,0 +1,590 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/template"
+	"time"
+
+	"cloudsqltail/messages"
+)
+
+// Outputs supported by -output
+const (
+	outputStdout     = "stdout"
+	outputUnixSocket = "unixsocket"
+	outputHTTP       = "http"
+	outputFile       = "file"
+	outputGCS        = "gcs"
+	outputHoneycomb  = "honeycomb"
+)
+
+// Output formats supported by -output-format
+const (
+	outputFormatText      = "text"
+	outputFormatNDJSON    = "ndjson"
+	outputFormatJSONArray = "json-array"
+	outputFormatParquet   = "parquet"
+
+	// Alias of outputFormatNDJSON
+	outputFormatJSON = "json"
+)
+
+// Modes supported by -output-file-mode
+const (
+	fileModeAppend   = "append"
+	fileModeTruncate = "truncate"
+)
+
+// Line endings supported by -line-ending
+const (
+	lineEndingLF   = "lf"
+	lineEndingCRLF = "crlf"
+)
+
+// Modes supported by -color
+const (
+	colorAuto   = "auto"
+	colorAlways = "always"
+	colorNever  = "never"
+)
+
+// ANSI escape sequence that resets the color of the text output
+const colorReset = "\x1b[0m"
+
+// Policies supported by -on-output-error
+const (
+	outputErrorExit  = "exit"
+	outputErrorDrop  = "drop"
+	outputErrorRetry = "retry"
+)
+
+// output that flushed messages are written to
+var output io.Writer = os.Stdout
+
+// lineEnding written after each line of the output, set by -line-ending
+var lineEnding = "\n"
+
+// colorize the lines of the text output by severity, set by -color
+var colorize bool
+
+// lineTemplate of -template, replacing the built-in text format if set
+var lineTemplate *template.Template
+
+// splitOutput that continuation lines are written to instead, if configured
+var splitOutput io.Writer
+
+// openOutput configured by -output
+func openOutput() error {
+	switch *flagOutput {
+	case outputUnixSocket:
+		output = &socketWriter{path: *flagSocketPath}
+	case outputHTTP:
+		w, err := newHTTPWriter()
+		if err != nil {
+			return err
+		}
+		output = w
+	case outputFile:
+		output = &fileWriter{
+			path:     *flagOutputFile,
+			window:   *flagOutputFileWindow,
+			atomic:   *flagAtomicFileWrites,
+			truncate: *flagOutputFileMode == fileModeTruncate,
+			gzip:     *flagGzip,
+		}
+	case outputHoneycomb:
+		output = newHoneycombWriter()
+	case outputGCS:
+		w, err := newGCSWriter()
+		if err != nil {
+			return err
+		}
+		output = w
+	default:
+		output = os.Stdout
+	}
+
+	switch *flagColor {
+	case colorAlways:
+		colorize = true
+	case colorAuto:
+		colorize = output == os.Stdout && isTerminal(os.Stdout)
+	}
+
+	switch *flagSplitOutput {
+	case "":
+	case "stderr":
+		splitOutput = os.Stderr
+	default:
+		f, err := os.OpenFile(*flagSplitOutput, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		splitOutput = f
+	}
+
+	return nil
+}
+
+// isTerminal reports whether the file is a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// severityColor of the lines of messages with the given severity in the text
+// output, as an ANSI escape sequence, or empty to leave them uncolored
+func severityColor(severity string) string {
+	switch severity {
+	case "ERROR", "CRITICAL", "ALERT", "EMERGENCY":
+		return "\x1b[31m"
+	case "WARNING":
+		return "\x1b[33m"
+	case "NOTICE":
+		return "\x1b[36m"
+	case "DEBUG":
+		return "\x1b[90m"
+	default:
+		return ""
+	}
+}
+
+// contentType of the output format, for outputs that label what they write
+func contentType() string {
+	switch *flagOutputFormat {
+	case outputFormatNDJSON:
+		return "application/x-ndjson"
+	case outputFormatJSONArray:
+		return "application/json"
+	default:
+		return "text/plain; charset=utf-8"
+	}
+}
+
+// outputExtension of the names of the objects written in the output format
+func outputExtension() string {
+	switch *flagOutputFormat {
+	case outputFormatNDJSON:
+		return ".ndjson"
+	case outputFormatJSONArray:
+		return ".json"
+	default:
+		return ".log"
+	}
+}
+
+// closeOutput that is not STDOUT, finishing the file being written
+func closeOutput() {
+	c, ok := output.(io.Closer)
+	if !ok || output == os.Stdout {
+		return
+	}
+
+	if err := c.Close(); err != nil {
+		logger.Error("could not close output", "error", err)
+	}
+}
+
+// formatTemplate writes the messages with a payload as one line each, by
+// executing the line template on them
+func formatTemplate(buf *bytes.Buffer, msgs []messages.ParsedMessage) error {
+	for i := range msgs {
+		msg := &msgs[i]
+		if msg.TextPayload == "" {
+			continue
+		}
+
+		if err := lineTemplate.Execute(buf, msg); err != nil {
+			return err
+		}
+		if b := buf.Bytes(); len(b) == 0 || b[len(b)-1] != '\n' {
+			buf.WriteString(lineEnding)
+		}
+	}
+
+	return nil
+}
+
+// field of an event in the JSON output formats
+type field struct {
+	key   string
+	value interface{}
+}
+
+// event is the representation of a message in the JSON output formats, as
+// an ordered list of fields so that its serialization is deterministic
+type event []field
+
+// MarshalJSON with the fields named by -field-order first, in that order,
+// followed by any others in the order they were added
+func (e event) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	written := make([]bool, len(e))
+
+	write := func(i int) error {
+		key, err := json.Marshal(e[i].key)
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(e[i].value)
+		if err != nil {
+			return err
+		}
+
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+		written[i] = true
+		return nil
+	}
+
+	buf.WriteByte('{')
+	for _, key := range fieldOrder {
+		for i := range e {
+			if e[i].key == key && !written[i] {
+				if err := write(i); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	for i := range e {
+		if !written[i] {
+			if err := write(i); err != nil {
+				return nil, err
+			}
+		}
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+// fieldOrder of the JSON output formats, parsed from -field-order
+var fieldOrder []string
+
+// batch of (sorted) messages written out by a single flush
+type batch struct {
+	msgs []messages.ParsedMessage
+
+	// Messages older than this arrived after the flush that should have
+	// written them, and are marked as late
+	lateBefore time.Time
+
+	// Set on the last flush before exiting
+	drain bool
+}
+
+// slice of the batch, with the messages from i up to j
+func (b batch) slice(i, j int) batch {
+	return batch{msgs: b.msgs[i:j], lateBefore: b.lateBefore, drain: b.drain}
+}
+
+// partialWriteError of a batch sent in several requests, when one of them
+// failed after the earlier ones were accepted
+type partialWriteError struct {
+	// Messages at the start of the batch that were written
+	written int
+
+	err error
+}
+
+func (e *partialWriteError) Error() string {
+	return e.err.Error()
+}
+
+func (e *partialWriteError) Unwrap() error {
+	return e.err
+}
+
+// afterWritten marks err as the failure of a part of a batch that follows n
+// messages that were written
+func afterWritten(n int, err error) error {
+	if err == nil || n == 0 {
+		return err
+	}
+
+	var partial *partialWriteError
+	if errors.As(err, &partial) {
+		return &partialWriteError{written: n + partial.written, err: partial.err}
+	}
+	return &partialWriteError{written: n, err: err}
+}
+
+// writtenBefore err, the number of messages at the start of a batch that
+// were written before it failed
+func writtenBefore(err error) int {
+	var partial *partialWriteError
+	if errors.As(err, &partial) {
+		return partial.written
+	}
+	return 0
+}
+
+// writeMessages formats the batch according to the output format and writes
+// it to w. When draining, formats that frame a batch still write an empty
+// frame so that the output remains valid.
+func writeMessages(w io.Writer, b batch) error {
+	if *flagOutputFormat == outputFormatJSONArray && len(b.msgs) == 0 && !b.drain {
+		return nil
+	}
+
+	if _, ok := w.(*httpWriter); ok {
+		return writeChunks(w, b)
+	}
+	if hw, ok := w.(*honeycombWriter); ok {
+		return hw.writeBatch(b)
+	}
+	if *flagOutputFormat == outputFormatParquet {
+		return w.(*fileWriter).writeRows(b)
+	}
+
+	buf, cont, err := formatBatch(b)
+	if err != nil {
+		return err
+	}
+	return writeFormatted(w, buf, cont)
+}
+
+// formatBatch according to the output format, with the lines that continue a
+// message sequence in cont when they go to the split output
+func formatBatch(b batch) (buf, cont *bytes.Buffer, err error) {
+	buf, cont = new(bytes.Buffer), new(bytes.Buffer)
+
+	switch *flagOutputFormat {
+	case outputFormatNDJSON:
+		err = formatNDJSON(buf, b)
+	case outputFormatJSONArray:
+		err = formatJSONArray(buf, b)
+	default:
+		if lineTemplate != nil {
+			err = formatTemplate(buf, b.msgs)
+		} else if splitOutput != nil {
+			formatText(buf, cont, b.msgs)
+		} else {
+			formatText(buf, buf, b.msgs)
+		}
+	}
+
+	return buf, cont, err
+}
+
+// writeFormatted output to w, and the continuation lines to the split output
+func writeFormatted(w io.Writer, buf, cont *bytes.Buffer) error {
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	if cont.Len() > 0 {
+		_, err := splitOutput.Write(cont.Bytes())
+		return err
+	}
+
+	return nil
+}
+
+// formatText writes the messages in the text format that honeytail consumes,
+// with the lines that continue a message sequence going to cont
+func formatText(buf, cont *bytes.Buffer, msgs []messages.ParsedMessage) {
+	for i := range msgs {
+		msg := &msgs[i]
+
+		if msg.TextPayload != "" {
+			// Continuation lines go to the split output, if there is one
+			out := buf
+			if !msg.StartsEntry() {
+				out = cont
+			}
+
+			color := ""
+			if colorize {
+				color = severityColor(msg.Severity)
+			}
+			out.WriteString(color)
+			out.WriteString(*flagLinePrefix)
+
+			// Print the timestamp if we have the first line in a message sequence
+			if msg.StartsEntry() {
+				timestamp := msg.Timestamp.In(timestampLocation).Format(*flagTimestampFormat)
+				_, _ = fmt.Fprintf(out, "[%s]: %s", timestamp, msg.TextPayload)
+			} else {
+				out.WriteString(msg.TextPayload)
+			}
+			out.WriteString(*flagLineSuffix)
+			if color != "" {
+				out.WriteString(colorReset)
+			}
+			out.WriteString(lineEnding)
+		}
+	}
+}
+
+// events for the messages of the batch that have a payload
+func events(b batch) []event {
+	events := make([]event, 0, len(b.msgs))
+	for i := range b.msgs {
+		msg := &b.msgs[i]
+		if msg.TextPayload == "" {
+			continue
+		}
+
+		// Split the prefix off the payload, whose rest may still be parsed
+		payload := msg.TextPayload
+		var prefix []field
+		if *flagParsePGPrefix {
+			prefix, payload, _ = parsePGPrefix(payload)
+		}
+
+		// The timestamp and severity are kept when a parsed payload replaces
+		// the message
+		e := event{{"timestamp", msg.Timestamp}}
+		if msg.Severity != "" {
+			e = append(e, field{"severity", msg.Severity})
+		}
+		header := len(e)
+		e = append(e, field{"message", payload})
+
+		// Replace the raw row with its columns, which include the message
+		if *flagParseCSVLog {
+			if columns, ok := parseCSVLog(payload); ok {
+				e = append(e[:header], columns...)
+			}
+		}
+
+		// Add the columns of a pgaudit record, leaving the message as it is
+		if *flagParsePGAudit {
+			if columns, ok := parsePGAudit(payload); ok {
+				e = append(e, columns...)
+			}
+		}
+
+		// Replace an embedded JSON object with its fields
+		if *flagParseEmbeddedJSON {
+			if fields, ok := parseEmbeddedJSON(payload); ok {
+				e = append(e[:header], withoutReserved(fields, e[:header])...)
+			}
+		}
+		e = append(e, prefix...)
+		if r := msg.HTTPRequest; r != nil {
+			e = appendHTTPRequest(e, r)
+		}
+		if o := msg.Operation; o != nil && o.ID != "" {
+			e = appendOperation(e, o)
+		}
+		e = appendSorted(e, *flagLabelPrefix, msg.Labels)
+		e = appendSorted(e, "", msg.Fields)
+		if msg.MessageID != "" {
+			e = append(e, field{"pubsub_message_id", msg.MessageID})
+		}
+		if id := msg.DatabaseID(); *flagAddDatabaseID && id != "" {
+			e = append(e, field{"database_id", id})
+		}
+		if msg.Subscription != "" {
+			e = append(e, field{"pubsub_subscription", msg.Subscription})
+		}
+		if msg.Sequence != 0 {
+			e = append(e, field{"sequence", msg.Sequence})
+		}
+		if !msg.Timestamp.IsZero() && msg.Timestamp.Before(b.lateBefore) {
+			e = append(e, field{"late", true})
+		}
+		events = append(events, e)
+	}
+
+	return events
+}
+
+// appendHTTPRequest fields that are set to the event
+func appendHTTPRequest(e event, r *messages.HTTPRequest) event {
+	if r.RequestMethod != "" {
+		e = append(e, field{"request_method", r.RequestMethod})
+	}
+	if r.Status != 0 {
+		e = append(e, field{"status", r.Status})
+	}
+	if r.UserAgent != "" {
+		e = append(e, field{"user_agent", r.UserAgent})
+	}
+	if r.RemoteIP != "" {
+		e = append(e, field{"remote_ip", r.RemoteIP})
+	}
+	return e
+}
+
+// appendOperation fields that are set to the event
+func appendOperation(e event, o *messages.Operation) event {
+	e = append(e, field{"operation_id", o.ID})
+	if o.Producer != "" {
+		e = append(e, field{"operation_producer", o.Producer})
+	}
+	if o.First {
+		e = append(e, field{"operation_first", true})
+	}
+	if o.Last {
+		e = append(e, field{"operation_last", true})
+	}
+	return e
+}
+
+// appendSorted values to the event as fields named after their keys with the
+// given prefix, in the order of their keys
+func appendSorted(e event, prefix string, values map[string]string) event {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		e = append(e, field{prefix + k, values[k]})
+	}
+	return e
+}
+
+// formatNDJSON writes the messages as one JSON event per line, followed by a
+// marker record with -batch-marker
+func formatNDJSON(buf *bytes.Buffer, b batch) error {
+	events := events(b)
+
+	// Mark the end of the batch, if asked to
+	if *flagBatchMarker && len(events) > 0 {
+		events = append(events, event{
+			{"_batch", true},
+			{"count", len(events)},
+			{"flushed_at", time.Now().UTC()},
+		})
+	}
+
+	for _, e := range events {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+
+		buf.Write(data)
+		buf.WriteString(lineEnding)
+	}
+
+	return nil
+}
+
+// formatJSONArray writes the messages as a single JSON array of events
+func formatJSONArray(buf *bytes.Buffer, b batch) error {
+	data, err := json.Marshal(events(b))
+	if err != nil {
+		return err
+	}
+
+	buf.Write(data)
+	buf.WriteString(lineEnding)
+	return nil
+}
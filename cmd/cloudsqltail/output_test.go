@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"cloudsqltail/messages"
+)
+
+func TestFormatNDJSONFieldOrder(t *testing.T) {
+	ts := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	msgs := []messages.ParsedMessage{
+		{Timestamp: ts, Severity: "ERROR", TextPayload: "[1]: ERROR:  relation does not exist", Labels: messages.Labels{"env": "prod"}},
+		{Timestamp: ts, TextPayload: "[1]: LOG:  no severity"},
+		{Timestamp: ts, Severity: "INFO", TextPayload: "2021-06-01 10:00:00 UTC,alice,app,123,10.0.0.1,abc.1,1,SELECT,,3/4,0,LOG,00000,checkpoint"},
+		{Timestamp: ts, Severity: "NOTICE", TextPayload: `{"msg":"embedded","severity":"replaced","level":"debug"}`},
+	}
+
+	tests := []struct {
+		name  string
+		order string
+		want  string
+	}{
+		{
+			name:  "default",
+			order: "timestamp,severity,message",
+			want: `{"timestamp":"2021-06-01T10:00:00Z","severity":"ERROR","message":"[1]: ERROR:  relation does not exist","label.env":"prod"}
+{"timestamp":"2021-06-01T10:00:00Z","message":"[1]: LOG:  no severity"}
+{"timestamp":"2021-06-01T10:00:00Z","severity":"INFO","message":"checkpoint","log_time":"2021-06-01 10:00:00 UTC","user_name":"alice","database_name":"app","process_id":123,"connection_from":"10.0.0.1","session_id":"abc.1","session_line_num":1,"command_tag":"SELECT","virtual_transaction_id":"3/4","transaction_id":0,"error_severity":"LOG","sql_state_code":"00000"}
+{"timestamp":"2021-06-01T10:00:00Z","severity":"NOTICE","msg":"embedded","level":"debug"}
+`,
+		},
+		{
+			name:  "custom",
+			order: "message,label.env,severity",
+			want: `{"message":"[1]: ERROR:  relation does not exist","label.env":"prod","severity":"ERROR","timestamp":"2021-06-01T10:00:00Z"}
+{"message":"[1]: LOG:  no severity","timestamp":"2021-06-01T10:00:00Z"}
+{"message":"checkpoint","severity":"INFO","timestamp":"2021-06-01T10:00:00Z","log_time":"2021-06-01 10:00:00 UTC","user_name":"alice","database_name":"app","process_id":123,"connection_from":"10.0.0.1","session_id":"abc.1","session_line_num":1,"command_tag":"SELECT","virtual_transaction_id":"3/4","transaction_id":0,"error_severity":"LOG","sql_state_code":"00000"}
+{"severity":"NOTICE","timestamp":"2021-06-01T10:00:00Z","msg":"embedded","level":"debug"}
+`,
+		},
+		{
+			name:  "none",
+			order: "",
+			want: `{"timestamp":"2021-06-01T10:00:00Z","severity":"ERROR","message":"[1]: ERROR:  relation does not exist","label.env":"prod"}
+{"timestamp":"2021-06-01T10:00:00Z","message":"[1]: LOG:  no severity"}
+{"timestamp":"2021-06-01T10:00:00Z","severity":"INFO","log_time":"2021-06-01 10:00:00 UTC","user_name":"alice","database_name":"app","process_id":123,"connection_from":"10.0.0.1","session_id":"abc.1","session_line_num":1,"command_tag":"SELECT","virtual_transaction_id":"3/4","transaction_id":0,"error_severity":"LOG","sql_state_code":"00000","message":"checkpoint"}
+{"timestamp":"2021-06-01T10:00:00Z","severity":"NOTICE","msg":"embedded","level":"debug"}
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, "parse-csvlog", "true")
+			setFlag(t, "parse-embedded-json", "true")
+			previous := fieldOrder
+			fieldOrder = splitList(tt.order)
+			t.Cleanup(func() { fieldOrder = previous })
+
+			var buf bytes.Buffer
+			if err := formatNDJSON(&buf, batch{msgs: append([]messages.ParsedMessage(nil), msgs...)}); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Marker that pgaudit logs its records after, as "AUDIT: SESSION,1,1,..."
+const pgauditMarker = "AUDIT: "
+
+// Columns of a pgaudit record, in order. Versions before the parameter one
+// leave it out.
+var pgauditColumns = []string{
+	"audit_type",
+	"statement_id",
+	"substatement_id",
+	"class",
+	"command",
+	"object_type",
+	"object_name",
+	"statement",
+	"parameter",
+}
+
+// Number of columns up to the statement, the least a record can have
+const pgauditMinColumns = 8
+
+// Columns of a pgaudit record that hold integers
+var pgauditIntColumns = map[string]bool{
+	"statement_id":    true,
+	"substatement_id": true,
+}
+
+// parsePGAudit record in the payload, after the pgaudit marker, into the
+// fields of its non-empty columns. The statement is quoted and may contain
+// commas, quotes and newlines. Reports false if the payload has no such
+// record.
+func parsePGAudit(payload string) ([]field, bool) {
+	i := strings.Index(payload, pgauditMarker)
+	if i < 0 {
+		return nil, false
+	}
+
+	r := csv.NewReader(strings.NewReader(payload[i+len(pgauditMarker):]))
+	r.FieldsPerRecord = -1
+
+	row, err := r.Read()
+	if err != nil || len(row) < pgauditMinColumns || len(row) > len(pgauditColumns) {
+		return nil, false
+	}
+	if _, err := r.Read(); err != io.EOF {
+		return nil, false
+	}
+
+	fields := make([]field, 0, len(row))
+	for i, value := range row {
+		if value == "" {
+			continue
+		}
+
+		name := pgauditColumns[i]
+		if pgauditIntColumns[name] {
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+				fields = append(fields, field{name, n})
+				continue
+			}
+		}
+		fields = append(fields, field{name, value})
+	}
+
+	return fields, true
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"cloudsqltail/messages"
+)
+
+func TestParsePGAudit(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    []field
+		ok      bool
+	}{
+		{
+			name:    "session record",
+			payload: "[1]: [2-1] db=app,user=alice LOG:  AUDIT: SESSION,1,1,READ,SELECT,,,select 1,<none>",
+			want: []field{
+				{"audit_type", "SESSION"}, {"statement_id", int64(1)}, {"substatement_id", int64(1)},
+				{"class", "READ"}, {"command", "SELECT"}, {"statement", "select 1"}, {"parameter", "<none>"},
+			},
+			ok: true,
+		},
+		{
+			name:    "quoted statement",
+			payload: "LOG:  AUDIT: OBJECT,3,1,WRITE,UPDATE,TABLE,public.account,\"update account set name = 'a, \"\"b\"\"'\n where id = 1\",<not logged>",
+			want: []field{
+				{"audit_type", "OBJECT"}, {"statement_id", int64(3)}, {"substatement_id", int64(1)},
+				{"class", "WRITE"}, {"command", "UPDATE"}, {"object_type", "TABLE"}, {"object_name", "public.account"},
+				{"statement", "update account set name = 'a, \"b\"'\n where id = 1"}, {"parameter", "<not logged>"},
+			},
+			ok: true,
+		},
+		{
+			name:    "without the parameter column",
+			payload: "AUDIT: SESSION,2,1,DDL,CREATE TABLE,TABLE,public.t,create table t (id int)",
+			want: []field{
+				{"audit_type", "SESSION"}, {"statement_id", int64(2)}, {"substatement_id", int64(1)},
+				{"class", "DDL"}, {"command", "CREATE TABLE"}, {"object_type", "TABLE"}, {"object_name", "public.t"},
+				{"statement", "create table t (id int)"},
+			},
+			ok: true,
+		},
+		{name: "not an audit record", payload: "[1]: [2-1] db=app,user=alice LOG:  statement: select 1"},
+		{name: "too few columns", payload: "LOG:  AUDIT: SESSION,1,1,READ"},
+		{name: "too many columns", payload: "LOG:  AUDIT: SESSION,1,1,READ,SELECT,,,select 1,<none>,extra"},
+		{name: "unterminated statement", payload: "LOG:  AUDIT: SESSION,1,1,READ,SELECT,,,\"select 1,<none>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parsePGAudit(tt.payload)
+			if ok != tt.ok {
+				t.Fatalf("got ok %t, want %t", ok, tt.ok)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventsWithPGAudit(t *testing.T) {
+	setFlag(t, "parse-pgaudit", "true")
+
+	ts := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	audit := "LOG:  AUDIT: SESSION,1,1,READ,SELECT,,,select 1,<none>"
+	e := events(batch{msgs: []messages.ParsedMessage{
+		{Timestamp: ts, TextPayload: audit},
+		{Timestamp: ts, TextPayload: "LOG:  checkpoint starting: time"},
+	}})
+	if len(e) != 2 {
+		t.Fatalf("got %d events, want 2", len(e))
+	}
+
+	// The message is kept along with the columns of the record
+	fields := map[string]interface{}{}
+	for _, f := range e[0] {
+		fields[f.key] = f.value
+	}
+	if fields["message"] != audit || fields["command"] != "SELECT" || fields["statement_id"] != int64(1) {
+		t.Errorf("got %v, want the message and the columns of the record", e[0])
+	}
+
+	// Other lines pass through unchanged
+	for _, f := range e[1] {
+		if f.key == "audit_type" {
+			t.Errorf("got %v, want no audit fields", e[1])
+		}
+	}
+}
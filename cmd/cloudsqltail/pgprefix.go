@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// Pattern of -pg-prefix-pattern, compiled at startup by compilePGPrefixPattern
+var pgPrefixPattern *regexp.Regexp
+
+// Named groups of the prefix pattern that hold integers
+var pgPrefixIntGroups = map[string]bool{
+	"pid":  true,
+	"line": true,
+}
+
+// Duration logged by log_min_duration_statement or log_duration, as in
+// "LOG:  duration: 1.234 ms"
+var pgDuration = regexp.MustCompile(`\b[A-Z]+:\s+duration: (\d+(?:\.\d+)?) ms`)
+
+// compilePGPrefixPattern given by -pg-prefix-pattern, if -parse-pg-prefix is
+// set. It must name the groups it extracts.
+func compilePGPrefixPattern() error {
+	if !*flagParsePGPrefix {
+		return nil
+	}
+
+	re, err := regexp.Compile(*flagPGPrefixPattern)
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid Postgres prefix pattern '%s': %s", *flagPGPrefixPattern, err.Error()))
+	}
+	named := false
+	for _, name := range re.SubexpNames() {
+		named = named || (name != "" && name != "message")
+	}
+	if !named {
+		return errors.New(fmt.Sprintf("Postgres prefix pattern '%s' must have a named group other than 'message'", *flagPGPrefixPattern))
+	}
+
+	pgPrefixPattern = re
+	return nil
+}
+
+// parsePGPrefix of the payload into a "pg." field per named group of the
+// prefix pattern that matched, with the pid and line as numbers, and the
+// pg.duration_ms of the statement if one is logged. Also returns the message
+// group if the pattern has one, or the payload otherwise. Reports false if it
+// does not match.
+func parsePGPrefix(payload string) ([]field, string, bool) {
+	m := pgPrefixPattern.FindStringSubmatchIndex(payload)
+	if m == nil {
+		return nil, payload, false
+	}
+
+	var fields []field
+	message := payload
+	for i, name := range pgPrefixPattern.SubexpNames() {
+		if name == "" || m[2*i] < 0 {
+			continue
+		}
+
+		value := payload[m[2*i]:m[2*i+1]]
+		switch {
+		case name == "message":
+			message = value
+			continue
+		case value == "":
+			continue
+		case pgPrefixIntGroups[name]:
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+				fields = append(fields, field{"pg." + name, n})
+				continue
+			}
+		case name == "duration_ms":
+			if d, err := strconv.ParseFloat(value, 64); err == nil {
+				fields = append(fields, field{"pg." + name, d})
+				continue
+			}
+		}
+		fields = append(fields, field{"pg." + name, value})
+	}
+
+	if pgPrefixPattern.SubexpIndex("duration_ms") < 0 {
+		if d := pgDuration.FindStringSubmatch(message); d != nil {
+			if ms, err := strconv.ParseFloat(d[1], 64); err == nil {
+				fields = append(fields, field{"pg.duration_ms", ms})
+			}
+		}
+	}
+
+	return fields, message, true
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"cloudsqltail/messages"
+)
+
+// Processor of the messages about to be flushed, applied in the order given
+// by -processor after the built-in cleanups. It returns the message to write,
+// which may be the one given, or false to drop it.
+type Processor interface {
+	Process(msg *messages.ParsedMessage) (*messages.ParsedMessage, bool)
+}
+
+// ProcessorFactory creates a processor from the argument given after its name
+// in -processor name=arg, empty if there is none
+type ProcessorFactory func(arg string) (Processor, error)
+
+// Factories of the processors that -processor can name
+var processorFactories = map[string]ProcessorFactory{
+	"redact":    newRedactProcessor,
+	"add-field": newAddFieldProcessor,
+}
+
+// RegisterProcessor factory under the given name, for forks to compile in
+// their own processors from an init function without patching this file. It
+// panics if the name is taken, rather than silently replacing a processor.
+func RegisterProcessor(name string, factory ProcessorFactory) {
+	if _, ok := processorFactories[name]; ok {
+		panic(fmt.Sprintf("processor '%s' registered twice", name))
+	}
+	processorFactories[name] = factory
+}
+
+// Processors given by -processor, created at startup by compileProcessors
+var processors []Processor
+
+// compileProcessors given by -processor
+func compileProcessors() error {
+	processors = nil
+	for _, spec := range flagProcessors {
+		name, arg, _ := strings.Cut(spec, "=")
+		factory, ok := processorFactories[name]
+		if !ok {
+			return errors.New(fmt.Sprintf("unknown processor '%s', known ones are: %s", name, strings.Join(processorNames(), ", ")))
+		}
+
+		p, err := factory(arg)
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid processor '%s': %s", spec, err.Error()))
+		}
+		processors = append(processors, p)
+	}
+
+	return nil
+}
+
+// processorNames that are registered, sorted
+func processorNames() []string {
+	names := make([]string, 0, len(processorFactories))
+	for name := range processorFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// process a message through the processors in order, reporting false as soon
+// as one of them drops it
+func process(msg *messages.ParsedMessage) (*messages.ParsedMessage, bool) {
+	for _, p := range processors {
+		var ok bool
+		if msg, ok = p.Process(msg); !ok {
+			return nil, false
+		}
+	}
+	return msg, true
+}
+
+// redactProcessor replaces the matches of a pattern in the payload with -redact-mask
+type redactProcessor struct {
+	re *regexp.Regexp
+}
+
+func newRedactProcessor(arg string) (Processor, error) {
+	re, err := regexp.Compile(arg)
+	if err != nil {
+		return nil, err
+	}
+	return redactProcessor{re: re}, nil
+}
+
+func (p redactProcessor) Process(msg *messages.ParsedMessage) (*messages.ParsedMessage, bool) {
+	msg.TextPayload = p.re.ReplaceAllLiteralString(msg.TextPayload, *flagRedactMask)
+	return msg, true
+}
+
+// addFieldProcessor sets a field, written with the JSON output formats
+type addFieldProcessor struct {
+	key, value string
+}
+
+func newAddFieldProcessor(arg string) (Processor, error) {
+	key, value, ok := strings.Cut(arg, ":")
+	if !ok || key == "" {
+		return nil, errors.New("expected add-field=key:value")
+	}
+	return addFieldProcessor{key: key, value: value}, nil
+}
+
+func (p addFieldProcessor) Process(msg *messages.ParsedMessage) (*messages.ParsedMessage, bool) {
+	if msg.Fields == nil {
+		msg.Fields = make(map[string]string)
+	}
+	msg.Fields[p.key] = p.value
+	return msg, true
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"cloudsqltail/messages"
+)
+
+// dropProcessor drops the messages with a payload containing its argument
+type dropProcessor struct {
+	match string
+}
+
+func (p dropProcessor) Process(msg *messages.ParsedMessage) (*messages.ParsedMessage, bool) {
+	if strings.Contains(msg.TextPayload, p.match) {
+		return nil, false
+	}
+	return msg, true
+}
+
+// useProcessors given to -processor for a test, with the drop processor
+// registered
+func useProcessors(t *testing.T, specs ...string) error {
+	t.Helper()
+	RegisterProcessor("drop", func(arg string) (Processor, error) { return dropProcessor{match: arg}, nil })
+	previous := flagProcessors
+	flagProcessors = specs
+	t.Cleanup(func() {
+		delete(processorFactories, "drop")
+		flagProcessors = previous
+		processors = nil
+	})
+	return compileProcessors()
+}
+
+func TestRegisterProcessorTwice(t *testing.T) {
+	if err := useProcessors(t); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("registered a processor twice without panicking")
+		}
+	}()
+	RegisterProcessor("redact", newRedactProcessor)
+}
+
+func TestCompileProcessors(t *testing.T) {
+	tests := []struct {
+		name  string
+		specs []string
+		err   string
+	}{
+		{name: "none"},
+		{name: "built-in and registered", specs: []string{"redact=secret", "add-field=env:prod", "drop=x"}},
+		{name: "unknown", specs: []string{"redact=secret", "uppercase"}, err: "unknown processor 'uppercase', known ones are: add-field, drop, redact"},
+		{name: "invalid pattern", specs: []string{"redact=("}, err: "invalid processor 'redact=('"},
+		{name: "missing value", specs: []string{"add-field=env"}, err: "invalid processor 'add-field=env': expected add-field=key:value"},
+		{name: "missing key", specs: []string{"add-field=:prod"}, err: "expected add-field=key:value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := useProcessors(t, tt.specs...)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(processors) != len(tt.specs) {
+					t.Errorf("got %d processors, want %d", len(processors), len(tt.specs))
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestBuiltInProcessors(t *testing.T) {
+	setFlag(t, "redact-mask", "***")
+
+	redact, err := newRedactProcessor(`password=\S+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, ok := redact.Process(&messages.ParsedMessage{TextPayload: "[1]: login password=hunter2 ok"})
+	if !ok || msg.TextPayload != "[1]: login *** ok" {
+		t.Errorf("got %v %t, want the password masked", msg, ok)
+	}
+
+	// The value can hold colons, the key cannot be empty
+	addField, err := newAddFieldProcessor("url:http://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, ok = addField.Process(&messages.ParsedMessage{Fields: map[string]string{"env": "prod"}})
+	if want := fmt.Sprint(map[string]string{"env": "prod", "url": "http://example.com"}); !ok || fmt.Sprint(msg.Fields) != want {
+		t.Errorf("got %v %t, want fields %s", msg.Fields, ok, want)
+	}
+	msg, ok = addField.Process(&messages.ParsedMessage{})
+	if !ok || msg.Fields["url"] != "http://example.com" {
+		t.Errorf("got %v %t, want the field added", msg.Fields, ok)
+	}
+}
+
+func TestProcessInOrder(t *testing.T) {
+	setFlag(t, "redact-mask", "***")
+	if err := useProcessors(t, "redact=secret", "drop=***", "add-field=env:prod"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Dropped by the processor after the redaction, the rest not being applied
+	if msg, ok := process(&messages.ParsedMessage{TextPayload: "[1]: secret"}); ok || msg != nil {
+		t.Errorf("got %v %t, want the message dropped", msg, ok)
+	}
+
+	msg, ok := process(&messages.ParsedMessage{TextPayload: "[1]: public"})
+	if !ok || msg.TextPayload != "[1]: public" || msg.Fields["env"] != "prod" {
+		t.Errorf("got %v %t, want the message kept with the field added", msg, ok)
+	}
+}
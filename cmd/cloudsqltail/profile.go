@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// profiles of -profile, the coherent defaults they give to the options that
+// determine throughput and latency
+var profiles = map[string]Config{
+	"low-latency": {
+		"flush-interval":           "1s",
+		"buffer-size":              10000,
+		"recv-routines":            1,
+		"max-outstanding-messages": 100,
+	},
+	"balanced": {
+		"flush-interval":           "5s",
+		"buffer-size":              100000,
+		"recv-routines":            runtime.NumCPU(),
+		"max-outstanding-messages": 1000,
+	},
+	"high-throughput": {
+		"flush-interval":           "15s",
+		"buffer-size":              1000000,
+		"recv-routines":            2 * runtime.NumCPU(),
+		"max-outstanding-messages": 10000,
+	},
+}
+
+// applyProfile given by -profile to the options that were not set by a flag
+// or the config file
+func applyProfile() error {
+	if *flagProfile == "" {
+		return nil
+	}
+
+	cfg, ok := profiles[*flagProfile]
+	if !ok {
+		names := make([]string, 0, len(profiles))
+		for name := range profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return errors.New(fmt.Sprintf("unknown profile '%s', must be one of: %s", *flagProfile, strings.Join(names, ", ")))
+	}
+
+	return cfg.apply()
+}
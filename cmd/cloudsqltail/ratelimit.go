@@ -0,0 +1,40 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+var (
+	// Lines that may still be written under -max-lines-per-second, refilled
+	// at that rate up to one -flush-interval's worth. The lock on the messages
+	// slice must be held.
+	lineTokens float64
+
+	// Time lineTokens was last refilled
+	lineTokensAt time.Time
+)
+
+// lineAllowance of the next flush under -max-lines-per-second, after
+// refilling it for the time since the last one. The lock on the messages
+// slice must be held.
+func lineAllowance() int {
+	rate := float64(*flagMaxLinesPerSecond)
+	burst := math.Max(1, rate*flagFlushInterval.Seconds())
+
+	now := time.Now()
+	if lineTokensAt.IsZero() {
+		lineTokens = burst
+	} else {
+		lineTokens = math.Min(burst, lineTokens+now.Sub(lineTokensAt).Seconds()*rate)
+	}
+	lineTokensAt = now
+
+	return int(lineTokens)
+}
+
+// spendLines written out of the allowance. The lock on the messages slice
+// must be held.
+func spendLines(n int) {
+	lineTokens -= float64(n)
+}
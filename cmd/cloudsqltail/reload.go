@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// Options that SIGHUP reloads from the config file. The others only take
+// effect on a restart.
+var reloadableOptions = []string{
+	"database-allowlist",
+	"field-order",
+	"redact-regex",
+	"redact-mask",
+	"redact-bind-params",
+}
+
+// Options given on the command line or by an environment variable, which a
+// reload leaves alone as they take precedence over the config file
+var commandLineOptions = make(map[string]bool)
+
+// noteCommandLineOptions once the command line and environment have been
+// parsed
+func noteCommandLineOptions() {
+	flag.Visit(func(f *flag.Flag) {
+		commandLineOptions[f.Name] = true
+	})
+}
+
+// compileReloadable options into the state they are used from
+func compileReloadable() error {
+	fieldOrder = splitList(*flagFieldOrder)
+
+	if ids := splitList(*flagDatabaseAllowlist); len(ids) > 0 {
+		allowlist := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			allowlist[id] = true
+		}
+		databaseAllowlist.Store(&allowlist)
+	} else {
+		databaseAllowlist.Store(nil)
+	}
+
+	return compileRedactions()
+}
+
+// watchReload signals, re-reading the reloadable options from the config
+// file, if there is one, and flushing on each SIGHUP
+func watchReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		if *flagConfig != "" {
+			reloadConfig()
+		}
+		buffer.Flush(false)
+	}
+}
+
+// reloadConfig file, swapping in the reloadable options it sets, or their
+// defaults if it no longer does, and warning about the other options that
+// changed. On an invalid value, the previous options are kept.
+func reloadConfig() {
+	cfg, err := loadConfig(*flagConfig)
+	if err != nil {
+		logger.Error("could not reload config file", "error", err)
+		return
+	}
+
+	// Flushing reads the options, so hold it off while swapping them
+	buffer.mx.Lock()
+	defer buffer.mx.Unlock()
+
+	previous := make(map[string][]string, len(reloadableOptions))
+	for _, name := range reloadableOptions {
+		previous[name] = optionValues(name)
+	}
+
+	err = setReloadable(cfg)
+	if err == nil {
+		err = compileReloadable()
+	}
+	if err != nil {
+		for _, name := range reloadableOptions {
+			resetOption(name)
+			for _, v := range previous[name] {
+				_ = flag.Set(name, v)
+			}
+		}
+		_ = compileReloadable()
+
+		logger.Error("could not reload config file, keeping the previous options", "error", err)
+		return
+	}
+
+	// Point out what could not be applied
+	reloadable := make(map[string]bool, len(reloadableOptions))
+	for _, name := range reloadableOptions {
+		reloadable[name] = true
+	}
+	for name, value := range cfg {
+		f := flag.Lookup(name)
+		if f == nil || name == "config" || reloadable[name] || commandLineOptions[name] {
+			continue
+		}
+
+		var values []string
+		for _, v := range configValues(value) {
+			values = append(values, fmt.Sprint(v))
+		}
+		if strings.Join(values, ",") != f.Value.String() {
+			logger.Warn("option changed in config file, restart to apply it", "option", name)
+		}
+	}
+
+	logger.Info("reloaded config file", "path", *flagConfig)
+}
+
+// setReloadable options to their values in the config, or to their defaults
+// when it does not have them
+func setReloadable(cfg Config) error {
+	for _, name := range reloadableOptions {
+		if commandLineOptions[name] {
+			continue
+		}
+
+		resetOption(name)
+		if value, ok := cfg[name]; ok {
+			if err := setOption(name, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// resetOption to its default value
+func resetOption(name string) {
+	if name == "redact-regex" {
+		flagRedactRegex = nil
+		return
+	}
+
+	f := flag.Lookup(name)
+	_ = f.Value.Set(f.DefValue)
+}
+
+// optionValues currently set, one per value of a repeatable option
+func optionValues(name string) []string {
+	if name == "redact-regex" {
+		return append([]string(nil), flagRedactRegex...)
+	}
+	return []string{flag.Lookup(name).Value.String()}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"cloudsqltail/messages"
+)
+
+// Sequence number of the next event written, with -add-sequence. The lock on
+// the messages slice must be held.
+var nextSequence uint64 = 1
+
+// loadSequence to continue from out of -sequence-state-file, if one is set
+// and a previous run left it
+func loadSequence() error {
+	if *flagSequenceStateFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(*flagSequenceStateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	n, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || n == 0 {
+		return errors.New(fmt.Sprintf("invalid sequence state file '%s'", *flagSequenceStateFile))
+	}
+
+	nextSequence = n
+	return nil
+}
+
+// assignSequence numbers to the messages about to be written, from the next
+// one, returning how many were numbered. Messages without a payload are not
+// written as events, so are not numbered. The lock on the messages slice must
+// be held.
+func assignSequence(msgs []messages.ParsedMessage) uint64 {
+	if !*flagAddSequence {
+		return 0
+	}
+
+	var n uint64
+	for i := range msgs {
+		if msgs[i].TextPayload == "" {
+			continue
+		}
+		msgs[i].Sequence = nextSequence + n
+		n++
+	}
+	return n
+}
+
+// sequencedIn the messages, the count of numbers assignSequence gave them
+func sequencedIn(msgs []messages.ParsedMessage) uint64 {
+	if !*flagAddSequence {
+		return 0
+	}
+
+	var n uint64
+	for i := range msgs {
+		if msgs[i].TextPayload != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// commitSequence numbers assigned to a batch that is done with, so that they
+// are not used again, and keep the next one in -sequence-state-file. The lock
+// on the messages slice must be held.
+func commitSequence(n uint64) {
+	if n == 0 {
+		return
+	}
+
+	nextSequence += n
+	if *flagSequenceStateFile == "" {
+		return
+	}
+
+	tmp := *flagSequenceStateFile + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(nextSequence, 10)+"\n"), 0644); err != nil {
+		logger.Error("could not write sequence state file", "error", err)
+		return
+	}
+	if err := os.Rename(tmp, *flagSequenceStateFile); err != nil {
+		logger.Error("could not write sequence state file", "error", err)
+	}
+}
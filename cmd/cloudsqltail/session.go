@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"cloudsqltail/messages"
+)
+
+// Pattern of -session-pattern, compiled at startup by compileSessionPattern
+var sessionPattern *regexp.Regexp
+
+// compileSessionPattern given by -session-pattern, if -group-by-session is set
+func compileSessionPattern() error {
+	if !*flagGroupBySession {
+		return nil
+	}
+
+	re, err := regexp.Compile(*flagSessionPattern)
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid session pattern '%s': %s", *flagSessionPattern, err.Error()))
+	}
+
+	sessionPattern = re
+	return nil
+}
+
+// sessionID in the payload, the first capture group of the session pattern
+// or its whole match if it has none, or empty if it does not match
+func sessionID(payload string) string {
+	m := sessionPattern.FindStringSubmatch(payload)
+	switch {
+	case m == nil:
+		return ""
+	case len(m) > 1:
+		return m[1]
+	default:
+		return m[0]
+	}
+}
+
+// groupBySession the sorted messages of a flush, so that the lines of each
+// session follow each other, in the order of the first line of each session.
+// Messages without a session ID, such as the continuation lines of a
+// statement, stay with the message before them.
+func groupBySession(msgs []messages.ParsedMessage) {
+	first := make(map[string]int)
+	groups := make([]int, len(msgs))
+	order := make([]int, len(msgs))
+	for i := range msgs {
+		groups[i], order[i] = i, i
+
+		id := sessionID(msgs[i].TextPayload)
+		switch g, ok := first[id]; {
+		case id == "" && i > 0:
+			groups[i] = groups[i-1]
+		case id == "":
+		case ok:
+			groups[i] = g
+		default:
+			first[id] = i
+		}
+	}
+
+	sort.SliceStable(order, func(a, b int) bool {
+		return groups[order[a]] < groups[order[b]]
+	})
+
+	grouped := make([]messages.ParsedMessage, len(msgs))
+	for i, j := range order {
+		grouped[i] = msgs[j]
+	}
+	copy(msgs, grouped)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// withTimeout runs the step, giving up on waiting for it after d, or never
+// if d is 0. Reports whether the step completed.
+func withTimeout(step string, d time.Duration, f func()) bool {
+	if d <= 0 {
+		f()
+		return true
+	}
+
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(d):
+		logger.Warn("timed out during shutdown", "step", step, "timeout", d.String())
+		return false
+	}
+}
+
+// Number of messages written by each flush of a drain, above which the drain
+// logs its progress
+const drainChunk = 10000
+
+// How often a drain logs its progress
+const drainProgressInterval = 5 * time.Second
+
+// drain the buffer. A large buffer is flushed a chunk at a time, logging the
+// progress, so that a long drain can be told apart from a hung one.
+func (buf *Buffer) drain() {
+	total := buf.Len()
+	if total <= drainChunk {
+		buf.Flush(true)
+		return
+	}
+
+	logger.Info("draining buffer", "messages", total)
+	drained := 0
+	lastLog := time.Now()
+	for {
+		before := buf.Len()
+		buf.flushAtMost(true, drainChunk)
+		after := buf.Len()
+
+		// Stop once empty, or once nothing more can be flushed
+		if after == 0 || after >= before {
+			break
+		}
+
+		drained += before - after
+		if time.Since(lastLog) >= drainProgressInterval {
+			logger.Info(fmt.Sprintf("drained %d of %d messages", drained, total))
+			lastLog = time.Now()
+		}
+	}
+
+	logger.Info("drained buffer", "messages", total)
+}
+
+// shutdown once receiving has stopped, in order: wait for the periodic
+// flushes to stop, drain the buffer, close the outputs so that buffered writes
+// and file footers are completed, then stop the HTTP server. Closing is
+// skipped if draining did not complete, as the drain may still be writing to
+// the outputs.
+func shutdown(flusherStopped <-chan struct{}) {
+	drained := withTimeout("drain", *flagDrainTimeout, func() {
+		// A flush in progress completes first, and no tick flushes after
+		// the drain, so that nothing is written to the closed outputs
+		<-flusherStopped
+		buffer.drain()
+	})
+
+	if drained {
+		withTimeout("close outputs", *flagCloseTimeout, func() {
+			closeOutput()
+			closeFlushStats()
+			closeDeadletter()
+			closeErrorOutput()
+			closeWAL()
+			closeDedupe()
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *flagHTTPShutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		logger.Warn("could not stop HTTP server", "error", err)
+	}
+}
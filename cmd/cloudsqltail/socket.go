@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// Attempts at connecting to the socket before giving up on a write
+const socketDialAttempts = 5
+
+// socketWriter writes to a Unix domain socket, connecting on first use and
+// reconnecting whenever the peer went away
+type socketWriter struct {
+	path string
+	conn net.Conn
+}
+
+// Write p to the socket, reconnecting once if the connection was broken
+func (s *socketWriter) Write(p []byte) (int, error) {
+	written := 0
+	for attempt := 0; ; attempt++ {
+		if s.conn == nil {
+			if err := s.dial(); err != nil {
+				return written, err
+			}
+		}
+
+		n, err := s.conn.Write(p[written:])
+		written += n
+		if err == nil || attempt > 0 {
+			return written, err
+		}
+
+		// The peer probably disconnected, so try again on a new connection
+		logger.Warn("lost connection to output socket, reconnecting", "path", s.path, "error", err)
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// dial the socket, retrying for a while in case the peer is not listening yet
+func (s *socketWriter) dial() error {
+	var err error
+	for attempt := 1; attempt <= socketDialAttempts; attempt++ {
+		var conn net.Conn
+		if conn, err = net.Dial("unix", s.path); err == nil {
+			s.conn = conn
+			return nil
+		}
+
+		if attempt < socketDialAttempts {
+			time.Sleep(retryBackoff(attempt))
+		}
+	}
+
+	return err
+}
+
+// Close the connection to the socket, if any
+func (s *socketWriter) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"container/heap"
+	"sort"
+	"strings"
+	"time"
+
+	"cloudsqltail/messages"
+)
+
+// Strategies supported by -sort-strategy
+const (
+	sortSlice = "slice"
+	sortHeap  = "heap"
+)
+
+// Timestamps supported by -sort-by
+const (
+	sortByCloudTimestamp = "cloud-timestamp"
+	sortByLineTimestamp  = "line-timestamp"
+)
+
+// Directions supported by -sort-order
+const (
+	sortAsc  = "asc"
+	sortDesc = "desc"
+)
+
+var (
+	// Sequence number given to the next buffered message, as the last tiebreaker
+	// between messages
+	nextSeq uint64
+
+	// Timestamp of the last buffered message, to tell when messages arrive out of order
+	lastArrival time.Time
+
+	// Latest sort time buffered for each ordering key, until the message
+	// holding it is flushed
+	lastKeySortTime = map[string]time.Time{}
+)
+
+// messageHeap is a min-heap of messages, kept in the messages slice with
+// -sort-strategy=heap so that messages are sorted as they arrive
+type messageHeap []messages.ParsedMessage
+
+func (h messageHeap) Len() int            { return len(h) }
+func (h messageHeap) Less(i, j int) bool  { return h[i].Less(&h[j]) }
+func (h messageHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *messageHeap) Push(x interface{}) { *h = append(*h, x.(messages.ParsedMessage)) }
+func (h *messageHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// insert the message into the messages slice. The lock on the messages slice
+// must be held.
+func (buf *Buffer) insert(pm messages.ParsedMessage) {
+	// Measure how out of order the messages arrive in
+	if *flagCountOutOfOrder {
+		if pm.Timestamp.Before(lastArrival) {
+			metricOutOfOrder.Inc()
+		}
+		lastArrival = pm.Timestamp
+	}
+
+	pm.Seq = nextSeq
+	pm.Received = time.Now()
+	nextSeq++
+
+	// Sort by the timestamp of the line prefix, if asked to and it has one
+	if *flagSortBy == sortByLineTimestamp {
+		if t, ok := lineTimestamp(pm.TextPayload); ok {
+			pm.SortTimestamp = t
+		}
+	}
+
+	// Never sort a message before one delivered earlier with the same
+	// ordering key, by sorting it as if it was just after it
+	if pm.OrderingKey != "" {
+		if last, ok := lastKeySortTime[pm.OrderingKey]; ok && !pm.SortTime().After(last) {
+			pm.SortTimestamp = last.Add(time.Nanosecond)
+		}
+		lastKeySortTime[pm.OrderingKey] = pm.SortTime()
+	}
+
+	if *flagSortStrategy == sortHeap {
+		heap.Push((*messageHeap)(&buf.msgs), pm)
+	} else {
+		buf.msgs = append(buf.msgs, pm)
+	}
+}
+
+// Number of bracketed fields at the start of a payload searched for its line
+// timestamp
+const lineTimestampFields = 5
+
+// lineTimestamp of the payload, the first of the bracketed fields its line
+// prefix starts with (such as "[2021-06-01 10:00:00.123 UTC]") that parses
+// with -line-timestamp-format, if any
+func lineTimestamp(payload string) (time.Time, bool) {
+	rest := payload
+	for i := 0; i < lineTimestampFields && strings.HasPrefix(rest, "["); i++ {
+		end := strings.IndexByte(rest, ']')
+		if end < 0 {
+			break
+		}
+
+		if t, err := time.Parse(*flagLineTimestampFormat, rest[1:end]); err == nil {
+			return t.UTC(), true
+		}
+		rest = strings.TrimLeft(rest[end+1:], ": ")
+	}
+
+	return time.Time{}, false
+}
+
+// takeFlushable messages out of the messages slice, sorted, leaving those
+// that are not older than the watermark behind. A zero watermark takes every
+// message. Messages without a timestamp sort first, and are never left behind.
+// At most limit messages are taken, unless it is 0. The lock on the messages
+// slice must be held.
+func (buf *Buffer) takeFlushable(watermark time.Time, limit int) []messages.ParsedMessage {
+	if *flagSortStrategy == sortHeap {
+		h := (*messageHeap)(&buf.msgs)
+
+		taken := make([]messages.ParsedMessage, 0, h.Len())
+		for h.Len() > 0 && (limit == 0 || len(taken) < limit) && (watermark.IsZero() || buf.msgs[0].SortTime().Before(watermark)) {
+			taken = append(taken, heap.Pop(h).(messages.ParsedMessage))
+		}
+		forgetOrderingKeys(taken)
+
+		return taken
+	}
+
+	// Sort the messages by timestamp, keeping the arrival order of any
+	// messages that cannot be told apart so that the output is deterministic
+	sort.SliceStable(buf.msgs, func(i, j int) bool {
+		return buf.msgs[i].Less(&buf.msgs[j])
+	})
+
+	n := len(buf.msgs)
+	if !watermark.IsZero() {
+		n = sort.Search(len(buf.msgs), func(i int) bool {
+			return !buf.msgs[i].SortTime().Before(watermark)
+		})
+	}
+	if limit > 0 && n > limit {
+		n = limit
+	}
+
+	// Reset the messages slice to the remaining messages, pre-allocating
+	// enough capacity to fit the same number of messages as we saw last time.
+	taken := buf.msgs[:n]
+	remaining := make([]messages.ParsedMessage, 0, len(buf.msgs))
+	buf.msgs = append(remaining, buf.msgs[n:]...)
+	forgetOrderingKeys(taken)
+
+	return taken
+}
+
+// forgetOrderingKeys of the messages taken out of the messages slice, whose
+// last message is among them, so that the keys seen do not build up. None of
+// their messages is left to sort a later one behind. The lock on the messages
+// slice must be held.
+func forgetOrderingKeys(taken []messages.ParsedMessage) {
+	for i := range taken {
+		key := taken[i].OrderingKey
+		if key != "" && !taken[i].SortTime().Before(lastKeySortTime[key]) {
+			delete(lastKeySortTime, key)
+		}
+	}
+}
+
+// overdue reports whether a buffered message was received before the given
+// time. The lock on the messages slice must be held.
+func (buf *Buffer) overdue(before time.Time) bool {
+	for i := range buf.msgs {
+		if buf.msgs[i].Received.Before(before) {
+			return true
+		}
+	}
+	return false
+}
+
+// restore messages taken out of the messages slice that could not be written,
+// so that they are flushed again later. The lock on the messages slice must
+// be held.
+func (buf *Buffer) restore(taken []messages.ParsedMessage) {
+	for i := range taken {
+		if key := taken[i].OrderingKey; key != "" && taken[i].SortTime().After(lastKeySortTime[key]) {
+			lastKeySortTime[key] = taken[i].SortTime()
+		}
+	}
+
+	if *flagSortStrategy == sortHeap {
+		h := (*messageHeap)(&buf.msgs)
+		for _, pm := range taken {
+			heap.Push(h, pm)
+		}
+
+		return
+	}
+
+	buf.msgs = append(taken, buf.msgs...)
+}
+
+// reverse the messages, for -sort-order=desc
+func reverse(msgs []messages.ParsedMessage) {
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"cloudsqltail/messages"
+)
+
+func TestOrderingKeyKeepsDeliveryOrder(t *testing.T) {
+	for _, strategy := range []string{sortSlice, sortHeap} {
+		t.Run(strategy, func(t *testing.T) {
+			buf, _ := newTestBuffer(t)
+			setFlag(t, "sort-strategy", strategy)
+
+			ts := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+			for _, pm := range []messages.ParsedMessage{
+				{Timestamp: ts, OrderingKey: "k", InsertID: "z", TextPayload: "first"},
+				{Timestamp: ts, OrderingKey: "k", InsertID: "a", TextPayload: "second"},
+				{Timestamp: ts.Add(-time.Second), OrderingKey: "k", InsertID: "b", TextPayload: "third"},
+				{Timestamp: ts, InsertID: "m", TextPayload: "unkeyed"},
+			} {
+				buf.insert(pm)
+			}
+
+			var got []string
+			for _, pm := range buf.takeFlushable(time.Time{}, 0) {
+				got = append(got, pm.TextPayload)
+			}
+			want := []string{"unkeyed", "first", "second", "third"}
+			if len(got) != len(want) {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Fatalf("got %v, want %v", got, want)
+				}
+			}
+
+			if len(lastKeySortTime) != 0 {
+				t.Errorf("ordering keys not forgotten once flushed: %v", lastKeySortTime)
+			}
+		})
+	}
+}
+
+func TestOrderingKeyKeptWhileBuffered(t *testing.T) {
+	buf, _ := newTestBuffer(t)
+	setFlag(t, "sort-strategy", sortSlice)
+
+	ts := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	buf.insert(messages.ParsedMessage{Timestamp: ts, OrderingKey: "k", TextPayload: "old"})
+	buf.insert(messages.ParsedMessage{Timestamp: ts.Add(time.Minute), OrderingKey: "k", TextPayload: "new"})
+
+	taken := buf.takeFlushable(ts.Add(time.Second), 0)
+	if len(taken) != 1 || taken[0].TextPayload != "old" {
+		t.Fatalf("took %v, want only the old message", taken)
+	}
+	if _, ok := lastKeySortTime["k"]; !ok {
+		t.Fatal("ordering key forgotten while one of its messages is buffered")
+	}
+
+	// Put back, the key is remembered again for the messages that follow
+	buf.takeFlushable(time.Time{}, 0)
+	buf.restore(taken)
+	if _, ok := lastKeySortTime["k"]; !ok {
+		t.Fatal("ordering key not remembered for a restored message")
+	}
+}
+
+// BenchmarkSort strategies, by the time spent under the lock when flushing a
+// buffer of messages received out of order, all of them or only the oldest
+// tenth as with a watermark, and by the total time including buffering them
+func BenchmarkSort(b *testing.B) {
+	ts := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	received := func(n int) []messages.ParsedMessage {
+		rng := rand.New(rand.NewSource(1))
+		msgs := make([]messages.ParsedMessage, n)
+		for i := range msgs {
+			msgs[i] = messages.ParsedMessage{
+				Timestamp:   ts.Add(time.Duration(rng.Intn(n)) * time.Millisecond),
+				InsertID:    strconv.Itoa(i),
+				TextPayload: "[1]: LOG:  statement: SELECT 1",
+			}
+		}
+		return msgs
+	}
+
+	for _, strategy := range []string{sortSlice, sortHeap} {
+		for _, n := range []int{1000, 100000} {
+			msgs := received(n)
+
+			b.Run(fmt.Sprintf("%s/%d/flush", strategy, n), func(b *testing.B) {
+				setFlag(b, "sort-strategy", strategy)
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					buf := NewBuffer(io.Discard)
+					for _, pm := range msgs {
+						buf.insert(pm)
+					}
+					b.StartTimer()
+
+					buf.takeFlushable(time.Time{}, 0)
+				}
+			})
+
+			// With -lateness, only the oldest messages are taken each flush
+			b.Run(fmt.Sprintf("%s/%d/watermark", strategy, n), func(b *testing.B) {
+				setFlag(b, "sort-strategy", strategy)
+				watermark := ts.Add(time.Duration(n/10) * time.Millisecond)
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					buf := NewBuffer(io.Discard)
+					for _, pm := range msgs {
+						buf.insert(pm)
+					}
+					b.StartTimer()
+
+					buf.takeFlushable(watermark, 0)
+				}
+			})
+
+			b.Run(fmt.Sprintf("%s/%d/total", strategy, n), func(b *testing.B) {
+				setFlag(b, "sort-strategy", strategy)
+				for i := 0; i < b.N; i++ {
+					buf := NewBuffer(io.Discard)
+					for _, pm := range msgs {
+						buf.insert(pm)
+					}
+					buf.takeFlushable(time.Time{}, 0)
+				}
+			})
+		}
+	}
+}
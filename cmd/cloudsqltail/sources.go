@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	logging "google.golang.org/api/logging/v2"
+)
+
+// Message sources supported by -source
+const (
+	sourcePubSub  = "pubsub"
+	sourceLogging = "logging"
+	sourceStdin   = "stdin"
+)
+
+// maxStdinLine is the longest line accepted from STDIN with -source=stdin
+const maxStdinLine = 16 * 1024 * 1024
+
+// pollLogging for new log entries through the Cloud Logging entries.list API,
+// feeding them into the messages slice until the context is done
+func pollLogging(ctx context.Context) error {
+	// Create a new Cloud Logging client
+	svc, err := logging.NewService(ctx, credentialOptions()...)
+	if err != nil {
+		return err
+	}
+
+	// Only fetch entries that were written after we started, keeping track of
+	// the entries already seen at the latest timestamp, since the filter on it
+	// is inclusive
+	last := time.Now().UTC()
+	seen := make(map[string]bool)
+
+	tick := time.NewTicker(*flagPollInterval)
+	defer tick.Stop()
+
+	for {
+		req := &logging.ListLogEntriesRequest{
+			ResourceNames: []string{"projects/" + *flagProject},
+			Filter:        fmt.Sprintf(`(%s) AND timestamp >= "%s"`, *flagLoggingFilter, last.Format(time.RFC3339Nano)),
+			OrderBy:       "timestamp asc",
+			PageSize:      1000,
+		}
+
+		err = svc.Entries.List(req).Pages(ctx, func(resp *logging.ListLogEntriesResponse) error {
+			for _, entry := range resp.Entries {
+				ts, err := time.Parse(time.RFC3339Nano, entry.Timestamp)
+				if err != nil {
+					continue
+				}
+
+				switch {
+				case ts.After(last):
+					last = ts
+					seen = make(map[string]bool)
+				case seen[entry.InsertId]:
+					continue
+				}
+				seen[entry.InsertId] = true
+
+				// Entries share the JSON schema of the Pub/Sub messages
+				data, err := json.Marshal(entry)
+				if err != nil {
+					continue
+				}
+				buffer.Add(data, entry.InsertId, "", "")
+			}
+
+			return nil
+		})
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Wait for the next poll
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tick.C:
+		}
+	}
+}
+
+// readStdin for newline-delimited JSON log entries, feeding them into the
+// messages slice until the end of the input or until the context is done
+func readStdin(ctx context.Context) error {
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), maxStdinLine)
+
+	// Scan in the background, as reading blocks until the next line
+	done := make(chan error, 1)
+	go func() {
+		for scanner.Scan() {
+			if ctx.Err() != nil {
+				break
+			}
+
+			line := scanner.Bytes()
+			if len(line) == 0 {
+				continue
+			}
+
+			// The scanner reuses its buffer, which the parsed payload must not share
+			buffer.Add(append([]byte(nil), line...), "", "", "")
+		}
+		done <- scanner.Err()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"cloudsqltail/messages"
+)
+
+var (
+	// Time the process started at, for the elapsed time of the summary
+	startTime = time.Now()
+
+	// Counters of the messages handled during the run, for the summary
+	summaryReceived atomic.Uint64
+	summaryFlushed  atomic.Uint64
+	summaryDropped  atomic.Uint64
+	summaryInvalid  atomic.Uint64
+
+	// Counters of the messages skipped since the last flush summary, by reason
+	skippedSeverity  atomic.Uint64
+	skippedExpired   atomic.Uint64
+	skippedDuplicate atomic.Uint64
+	skippedFiltered  atomic.Uint64
+
+	// Messages received as of the last flush summary, guarded by mx
+	flushSummaryReceived uint64
+)
+
+// StatsSnapshot of the message counters
+type StatsSnapshot struct {
+	Received uint64 `json:"received"`
+	Flushed  uint64 `json:"flushed"`
+	Dropped  uint64 `json:"dropped"`
+	Invalid  uint64 `json:"invalid"`
+}
+
+// Stats of the messages handled so far. The counters are read in the reverse
+// order of the pipeline, so that a snapshot never accounts for more messages
+// flushed, dropped or rejected than it has received.
+func Stats() StatsSnapshot {
+	var s StatsSnapshot
+	s.Flushed = summaryFlushed.Load()
+	s.Dropped = summaryDropped.Load()
+	s.Invalid = summaryInvalid.Load()
+	s.Received = summaryReceived.Load()
+	return s
+}
+
+// logSummary of the messages handled during the run, for bounded runs or if
+// requested by -summary
+func logSummary() {
+	if !*flagSummary && *flagMaxRuntime == 0 && *flagMaxEvents == 0 {
+		return
+	}
+
+	stats := Stats()
+	logger.Info(
+		"summary",
+		"received", stats.Received,
+		"flushed", stats.Flushed,
+		"dropped", stats.Dropped,
+		"invalid", stats.Invalid,
+		"elapsed", time.Since(startTime).Round(time.Millisecond).String(),
+	)
+}
+
+// logFlushSummary of the messages received since the previous flush, those of
+// the batch that were emitted, and those skipped along the way, if requested
+// by -log-flush-summary. The batch failed to be written if not written. The
+// lock on the messages slice must be held.
+func logFlushSummary(msgs []messages.ParsedMessage, written bool) {
+	if !*flagLogFlushSummary {
+		return
+	}
+
+	emitted, empty := 0, 0
+	for i := range msgs {
+		if msgs[i].TextPayload == "" {
+			empty++
+		} else if written {
+			emitted++
+		}
+	}
+
+	received := summaryReceived.Load()
+	logger.Info(
+		"flush summary",
+		"received", received-flushSummaryReceived,
+		"emitted", emitted,
+		"failed", len(msgs)-emitted-empty,
+		"skipped_empty", empty,
+		"skipped_severity", skippedSeverity.Swap(0),
+		"skipped_expired", skippedExpired.Swap(0),
+		"skipped_duplicate", skippedDuplicate.Swap(0),
+		"skipped_filtered", skippedFiltered.Swap(0),
+	)
+	flushSummaryReceived = received
+}
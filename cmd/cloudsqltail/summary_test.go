@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"cloudsqltail/messages"
+)
+
+// resetStats counters to zero for a test, restoring them afterwards
+func resetStats(t *testing.T) {
+	t.Helper()
+	counters := []*atomic.Uint64{&summaryReceived, &summaryFlushed, &summaryDropped, &summaryInvalid}
+	previous := make([]uint64, len(counters))
+	for i, c := range counters {
+		previous[i] = c.Swap(0)
+	}
+	t.Cleanup(func() {
+		for i, c := range counters {
+			c.Store(previous[i])
+		}
+	})
+}
+
+func TestStatsAccountForEveryMessage(t *testing.T) {
+	resetStats(t)
+	useDedupeFilter(t)
+	captureLogs(t)
+	setFlag(t, "min-severity", "WARNING")
+	previous := minSeverity
+	minSeverity, _ = messages.SeverityLevel("WARNING")
+	t.Cleanup(func() { minSeverity = previous })
+
+	buf, out := newTestBuffer(t)
+	buffer = buf
+	t.Cleanup(func() { buffer = nil })
+
+	for _, data := range []string{
+		`{"timestamp":"2021-06-01T10:00:01Z","severity":"ERROR","insertId":"a","textPayload":"[1]: first"}`,
+		`{"timestamp":"2021-06-01T10:00:02Z","severity":"WARNING","insertId":"b","textPayload":"[1]: second"}`,
+		`{"timestamp":"2021-06-01T10:00:03Z","severity":"INFO","insertId":"c","textPayload":"[1]: filtered"}`,
+		`not JSON`,
+	} {
+		buf.Add([]byte(data), "", "", "")
+	}
+	buf.Flush(false)
+
+	// Delivered again once written
+	buf.Add([]byte(`{"timestamp":"2021-06-01T10:00:01Z","severity":"ERROR","insertId":"a","textPayload":"[1]: first"}`), "", "", "")
+	buf.Flush(false)
+
+	want := StatsSnapshot{Received: 5, Flushed: 2, Dropped: 2, Invalid: 1}
+	if got := Stats(); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("%d messages left in the buffer, want none", buf.Len())
+	}
+	if out.Len() == 0 {
+		t.Error("nothing written")
+	}
+
+	// The status reports the same counts
+	rec := httptest.NewRecorder()
+	serveStatus(rec, httptest.NewRequest("GET", "/status", nil))
+	var status struct {
+		Messages StatsSnapshot `json:"messages"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("could not decode the status %q: %s", rec.Body, err)
+	}
+	if status.Messages != want {
+		t.Errorf("got status counts %+v, want %+v", status.Messages, want)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"cloudsqltail/messages"
+)
+
+// Handling of invalid UTF-8 supported by -invalid-utf8
+const (
+	invalidUTF8Repair = "repair"
+	invalidUTF8Drop   = "drop"
+	invalidUTF8Keep   = "keep"
+)
+
+// ansiEscape matches ANSI escape sequences: CSI sequences such as colors,
+// OSC sequences such as window titles, and the remaining two-byte escapes
+var ansiEscape = regexp.MustCompile(`\x1b(\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(\x07|\x1b\\)|[@-Z\\-_])`)
+
+// bindParam matches the value of a bind parameter in the "parameters: $1 = '...'"
+// detail lines that Postgres logs along with statements
+var bindParam = regexp.MustCompile(`(\$\d+ = )'(?:[^']|'')*'`)
+
+// whitespace matches runs of whitespace, including newlines
+var whitespace = regexp.MustCompile(`\s+`)
+
+// whitespaceOrLiteral matches runs of whitespace or whole quoted string
+// literals, which are left alone when compacting safely. An unterminated
+// literal extends to the end of the payload.
+var whitespaceOrLiteral = regexp.MustCompile(`'(?:[^']|'')*'?|\s+`)
+
+// Patterns of -redact-regex, compiled at startup by compileRedactions
+var redactPatterns []*regexp.Regexp
+
+// compileRedactions patterns given by -redact-regex
+func compileRedactions() error {
+	redactPatterns = nil
+	for _, expr := range flagRedactRegex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid redaction pattern '%s': %s", expr, err.Error()))
+		}
+		redactPatterns = append(redactPatterns, re)
+	}
+
+	return nil
+}
+
+// dropInvalidUTF8 bytes of a received message with -invalid-utf8=drop, before
+// it is parsed, as decoding the JSON would replace them in its strings
+// otherwise. There is no keeping them through decoding, so -invalid-utf8=keep
+// only applies to payloads that were not decoded, as with -emit-raw-on-error.
+func dropInvalidUTF8(data []byte) []byte {
+	if *flagInvalidUTF8 != invalidUTF8Drop || utf8.Valid(data) {
+		return data
+	}
+
+	return bytes.ToValidUTF8(data, nil)
+}
+
+// transform the payload of a message that is about to be flushed, according
+// to the configured cleanups
+func transform(msg *messages.ParsedMessage) {
+	// Make sure the payload is valid UTF-8 for the consumers, before the
+	// other cleanups match on it
+	if *flagInvalidUTF8 != invalidUTF8Keep && !utf8.ValidString(msg.TextPayload) {
+		replacement := string(utf8.RuneError)
+		if *flagInvalidUTF8 == invalidUTF8Drop {
+			replacement = ""
+		}
+		msg.TextPayload = strings.ToValidUTF8(msg.TextPayload, replacement)
+	}
+
+	if *flagStripANSI {
+		msg.TextPayload = ansiEscape.ReplaceAllString(msg.TextPayload, "")
+	}
+
+	// Mask sensitive content
+	for _, re := range redactPatterns {
+		msg.TextPayload = re.ReplaceAllLiteralString(msg.TextPayload, *flagRedactMask)
+	}
+	if *flagRedactBindParams {
+		msg.TextPayload = bindParam.ReplaceAllString(msg.TextPayload, "${1}'"+strings.ReplaceAll(*flagRedactMask, "$", "$$")+"'")
+	}
+
+	// Collapse runs of whitespace into single spaces
+	switch flagCompactWhitespace {
+	case compactAll:
+		msg.TextPayload = whitespace.ReplaceAllLiteralString(msg.TextPayload, " ")
+	case compactSafe:
+		msg.TextPayload = whitespaceOrLiteral.ReplaceAllStringFunc(msg.TextPayload, func(m string) string {
+			if strings.HasPrefix(m, "'") {
+				return m
+			}
+			return " "
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"cloudsqltail/messages"
+)
+
+// Payloads with "é" (0xc3 0xa9) and "€" (0xe2 0x82 0xac) split, as when a
+// line is cut in the middle of a rune
+const (
+	splitTwoByteRune   = "[1]: caf\xc3"
+	splitThreeByteRune = "[1]: \xa9 costs 5\xe2\x82"
+)
+
+func TestTransformInvalidUTF8(t *testing.T) {
+	tests := []struct {
+		mode    string
+		payload string
+		want    string
+	}{
+		{mode: invalidUTF8Repair, payload: splitTwoByteRune, want: "[1]: caf�"},
+		{mode: invalidUTF8Repair, payload: splitThreeByteRune, want: "[1]: � costs 5�"},
+		{mode: invalidUTF8Repair, payload: "[1]: café", want: "[1]: café"},
+		{mode: invalidUTF8Drop, payload: splitTwoByteRune, want: "[1]: caf"},
+		{mode: invalidUTF8Drop, payload: splitThreeByteRune, want: "[1]:  costs 5"},
+		{mode: invalidUTF8Keep, payload: splitTwoByteRune, want: splitTwoByteRune},
+		{mode: invalidUTF8Keep, payload: splitThreeByteRune, want: splitThreeByteRune},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			setFlag(t, "invalid-utf8", tt.mode)
+
+			msg := messages.ParsedMessage{TextPayload: tt.payload}
+			transform(&msg)
+			if msg.TextPayload != tt.want {
+				t.Errorf("got %q, want %q", msg.TextPayload, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddInvalidUTF8(t *testing.T) {
+	tests := []struct {
+		mode string
+		data string
+		want string
+	}{
+		// Decoding the JSON repairs the entry in any mode but drop
+		{mode: invalidUTF8Repair, data: `{"textPayload":"` + splitTwoByteRune + `"}`, want: "[1]: caf�"},
+		{mode: invalidUTF8Drop, data: `{"textPayload":"` + splitThreeByteRune + `"}`, want: "[1]:  costs 5"},
+		{mode: invalidUTF8Keep, data: `{"textPayload":"` + splitTwoByteRune + `"}`, want: "[1]: caf�"},
+
+		// Emitted raw, it is not decoded
+		{mode: invalidUTF8Keep, data: `{"textPayload":"` + splitTwoByteRune, want: rawPayloadPrefix + `{"textPayload":"` + splitTwoByteRune},
+		{mode: invalidUTF8Drop, data: `{"textPayload":"` + splitTwoByteRune, want: rawPayloadPrefix + `{"textPayload":"[1]: caf`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			buf, _ := newTestBuffer(t)
+			setFlag(t, "invalid-utf8", tt.mode)
+			setFlag(t, "emit-raw-on-error", "true")
+			captureLogs(t)
+
+			buf.Add([]byte(tt.data), "", "", "")
+			if len(buf.msgs) != 1 {
+				t.Fatalf("buffered %d messages, want 1", len(buf.msgs))
+			}
+			transform(&buf.msgs[0])
+			if got := buf.msgs[0].TextPayload; got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import "fmt"
+
+// Build metadata, injected at build time with e.g.
+// -ldflags "-X main.version=v1.2.3 -X main.commit=abc1234 -X main.buildDate=2021-06-01T10:00:00Z"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// versionLine describing the build, as printed by -version
+func versionLine() string {
+	return fmt.Sprintf("cloudsqltail %s (commit %s, built %s)", version, commit, buildDate)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"cloudsqltail/messages"
+)
+
+var (
+	// Write-ahead log that buffered messages are appended to, if configured
+	walFile *os.File
+
+	// Size of the write-ahead log, in bytes
+	walSize int64
+
+	// Set once the write-ahead log reached -wal-max-size, until it is compacted
+	walFull bool
+)
+
+// Mode of the write-ahead log, only readable by its owner as it holds the
+// payloads before they are redacted
+const walMode = 0600
+
+// walRecord of a buffered message, along with the Pub/Sub details that are
+// not part of the entry itself
+type walRecord struct {
+	messages.ParsedMessage
+	MessageID    string `json:"messageId,omitempty"`
+	OrderingKey  string `json:"orderingKey,omitempty"`
+	Subscription string `json:"subscription,omitempty"`
+}
+
+// encodeWALRecord of a buffered message, as a line of the write-ahead log
+// without the newline
+func encodeWALRecord(pm *messages.ParsedMessage) ([]byte, error) {
+	return json.Marshal(walRecord{
+		ParsedMessage: *pm,
+		MessageID:     pm.MessageID,
+		OrderingKey:   pm.OrderingKey,
+		Subscription:  pm.Subscription,
+	})
+}
+
+// decodeWALRecord of a line of the write-ahead log
+func decodeWALRecord(line []byte) (messages.ParsedMessage, error) {
+	var r walRecord
+	if err := json.Unmarshal(line, &r); err != nil {
+		return messages.ParsedMessage{}, err
+	}
+	pm := r.ParsedMessage
+	pm.MessageID, pm.OrderingKey, pm.Subscription = r.MessageID, r.OrderingKey, r.Subscription
+	return pm, nil
+}
+
+// openWAL given by -wal-path, if one is set, first replaying the messages it
+// holds from a previous run into the buffer
+func openWAL(buf *Buffer) error {
+	if *flagWALPath == "" {
+		return nil
+	}
+
+	if err := replayWAL(buf); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(*flagWALPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, walMode)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err == nil && info.Mode().Perm() != walMode {
+		// Left readable by an older version
+		err = f.Chmod(walMode)
+	}
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	walFile = f
+	walSize = info.Size()
+	return nil
+}
+
+// replayWAL messages into the buffer, once each by insert ID, as they were
+// buffered but not flushed before the previous run stopped. Those in the
+// dedupe filter were written just before it stopped, before the log was
+// compacted, and are left out.
+func replayWAL(buf *Buffer) error {
+	f, err := os.Open(*flagWALPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf.mx.Lock()
+	defer buf.mx.Unlock()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxStdinLine)
+
+	seen := make(map[string]bool)
+	replayed, written := 0, 0
+	for scanner.Scan() {
+		pm, err := decodeWALRecord(scanner.Bytes())
+		if err != nil {
+			// A crash may have cut the last record short
+			logger.Warn("skipped unreadable write-ahead log record", "error", err)
+			continue
+		}
+
+		if pm.InsertID != "" {
+			if seen[pm.InsertID] {
+				continue
+			}
+			seen[pm.InsertID] = true
+		}
+		if seenBefore(&pm) {
+			written++
+			continue
+		}
+
+		buf.insert(pm)
+		buf.bytes += len(pm.TextPayload)
+		replayed++
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.New(fmt.Sprintf("could not replay write-ahead log '%s': %s", *flagWALPath, err.Error()))
+	}
+
+	if replayed > 0 || written > 0 {
+		logger.Info("replayed write-ahead log", "path", *flagWALPath, "messages", replayed, "already_written", written)
+	}
+	return nil
+}
+
+// walAppend a buffered message to the write-ahead log, unless it is full.
+// The lock on the messages slice must be held.
+func walAppend(pm *messages.ParsedMessage) {
+	if walFile == nil {
+		return
+	}
+
+	line, err := encodeWALRecord(pm)
+	if err != nil {
+		logger.Error("could not encode write-ahead log record", "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	if *flagWALMaxSize > 0 && walSize+int64(len(line)) > *flagWALMaxSize {
+		if !walFull {
+			walFull = true
+			logger.Warn("write-ahead log is full, buffering messages in memory only until the next flush", "size", walSize)
+		}
+		return
+	}
+
+	n, err := walFile.Write(line)
+	walSize += int64(n)
+	if err != nil {
+		logger.Error("could not write to write-ahead log", "error", err)
+	}
+}
+
+// compactWAL once a flush succeeded, replacing it with the messages that are
+// still buffered. The lock on the messages slice must be held.
+func compactWAL(buffered []messages.ParsedMessage) {
+	if walFile == nil {
+		return
+	}
+
+	tmp := *flagWALPath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, walMode)
+	if err != nil {
+		logger.Error("could not compact write-ahead log", "error", err)
+		return
+	}
+
+	w := bufio.NewWriter(f)
+	var size int64
+	full := false
+	for i := range buffered {
+		line, err := encodeWALRecord(&buffered[i])
+		if err != nil {
+			continue
+		}
+		if *flagWALMaxSize > 0 && size+int64(len(line))+1 > *flagWALMaxSize {
+			full = true
+			break
+		}
+		_, _ = w.Write(line)
+		_ = w.WriteByte('\n')
+		size += int64(len(line)) + 1
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, *flagWALPath)
+	}
+	if err != nil {
+		logger.Error("could not compact write-ahead log", "error", err)
+		_ = os.Remove(tmp)
+		return
+	}
+
+	// Carry on appending to the compacted log
+	_ = walFile.Close()
+	walFile, err = os.OpenFile(*flagWALPath, os.O_APPEND|os.O_WRONLY, walMode)
+	if err != nil {
+		logger.Error("could not reopen write-ahead log", "error", err)
+		walFile = nil
+		return
+	}
+	walSize = size
+	walFull = full
+}
+
+// closeWAL, if one is open
+func closeWAL() {
+	buffer.mx.Lock()
+	defer buffer.mx.Unlock()
+
+	if walFile == nil {
+		return
+	}
+
+	if err := walFile.Close(); err != nil {
+		logger.Error("could not close write-ahead log", "error", err)
+	}
+	walFile = nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cloudsqltail/messages"
+)
+
+// useWAL at a new path for a test
+func useWAL(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "wal")
+	setFlag(t, "wal-path", path)
+	t.Cleanup(func() {
+		if walFile != nil {
+			_ = walFile.Close()
+		}
+		walFile, walSize, walFull = nil, 0, false
+	})
+	return path
+}
+
+func TestWALKeepsPubSubDetails(t *testing.T) {
+	path := useWAL(t)
+	captureLogs(t)
+	buf, _ := newTestBuffer(t)
+	if err := openWAL(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	pm := messages.ParsedMessage{
+		InsertID:     "a",
+		TextPayload:  "[1]: first",
+		MessageID:    "1234",
+		OrderingKey:  "db-1",
+		Subscription: "projects/p/subscriptions/s",
+	}
+	walAppend(&pm)
+	walAppend(&messages.ParsedMessage{InsertID: "b", TextPayload: "[1]: second"})
+
+	// Still there once the log is compacted
+	compactWAL([]messages.ParsedMessage{pm})
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != walMode {
+		t.Errorf("got mode %v, want %v", mode, os.FileMode(walMode))
+	}
+
+	replayed, _ := newTestBuffer(t)
+	if err := replayWAL(replayed); err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed.msgs) != 1 {
+		t.Fatalf("replayed %d messages, want 1", len(replayed.msgs))
+	}
+	got := replayed.msgs[0]
+	if got.InsertID != pm.InsertID || got.TextPayload != pm.TextPayload || got.MessageID != pm.MessageID || got.OrderingKey != pm.OrderingKey || got.Subscription != pm.Subscription {
+		t.Errorf("replayed %+v, want %+v", got, pm)
+	}
+}
+
+func TestOpenWALRestrictsMode(t *testing.T) {
+	path := useWAL(t)
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, _ := newTestBuffer(t)
+	if err := openWAL(buf); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != walMode {
+		t.Errorf("got mode %v, want %v", mode, os.FileMode(walMode))
+	}
+}
@@ -1,11 +1,192 @@
 package messages
 
 import (
+	"bytes"
+	"encoding/json"
 	"time"
 )
 
 // ParsedMessage holds the relevant details from a parsed Cloud Subscription message
 type ParsedMessage struct {
+	InsertID    string    `json:"insertId"`
 	TextPayload string    `json:"textPayload"`
 	Timestamp   time.Time `json:"timestamp"`
+	Severity    string    `json:"severity"`
+	Resource    Resource  `json:"resource"`
+	Labels      Labels    `json:"labels"`
+
+	// JSONPayload of a structured entry, which has no text payload. Its
+	// compacted JSON becomes the text payload once parsed.
+	JSONPayload json.RawMessage `json:"jsonPayload,omitempty"`
+
+	// HTTPRequest of the entry, which only some audit and connection logs have
+	HTTPRequest *HTTPRequest `json:"httpRequest"`
+
+	// Operation the entry is part of, for operations logged as several entries
+	Operation *Operation `json:"operation"`
+
+	// Fields added while processing the message, written with the JSON
+	// output formats
+	Fields map[string]string `json:"-"`
+
+	// Seq is the order in which the message was buffered
+	Seq uint64 `json:"-"`
+
+	// Sequence number the message is written with, with -add-sequence
+	Sequence uint64 `json:"-"`
+
+	// MessageID of the Pub/Sub message the entry was delivered in, with
+	// -add-message-id
+	MessageID string `json:"-"`
+
+	// Subscription the entry was received from, with -add-subscription
+	Subscription string `json:"-"`
+
+	// OrderingKey of the Pub/Sub message, set when the delivery order of
+	// messages sharing a key is preserved
+	OrderingKey string `json:"-"`
+
+	// Received is when the message was buffered
+	Received time.Time `json:"-"`
+
+	// SortTimestamp overrides the timestamp the message is sorted by, when
+	// it is not zero
+	SortTimestamp time.Time `json:"-"`
+}
+
+// Resource is the monitored resource that produced a log entry
+type Resource struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels"`
+}
+
+// Labels attached to a log entry. Values that are not strings are kept as
+// their JSON text, and labels that are not an object are ignored, rather than
+// failing the whole entry.
+type Labels map[string]string
+
+// UnmarshalJSON labels, accepting values of any type
+func (l *Labels) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		*l = nil
+		return nil
+	}
+
+	labels := make(Labels, len(raw))
+	for k, v := range raw {
+		var s string
+		if err := json.Unmarshal(v, &s); err != nil {
+			s = string(v)
+		}
+		labels[k] = s
+	}
+	*l = labels
+
+	return nil
+}
+
+// HTTPRequest that a log entry is about, with the fields we capture
+type HTTPRequest struct {
+	RequestMethod string `json:"requestMethod"`
+	Status        int    `json:"status"`
+	UserAgent     string `json:"userAgent"`
+	RemoteIP      string `json:"remoteIp"`
+}
+
+// Operation that groups related log entries
+type Operation struct {
+	ID       string `json:"id"`
+	Producer string `json:"producer"`
+	First    bool   `json:"first"`
+	Last     bool   `json:"last"`
+}
+
+// UseJSONPayload as the text payload, compacted to a single line, if the
+// message has a JSON payload but no text payload
+func (m *ParsedMessage) UseJSONPayload() {
+	if m.TextPayload != "" || len(m.JSONPayload) == 0 || string(m.JSONPayload) == "null" {
+		m.JSONPayload = nil
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, m.JSONPayload); err != nil {
+		m.JSONPayload = nil
+		return
+	}
+	m.JSONPayload = buf.Bytes()
+	m.TextPayload = buf.String()
+}
+
+// StartsEntry reports whether the message is the first line of a log entry,
+// rather than one continuing the message before it: a line starting with the
+// Postgres line prefix, or a JSON payload
+func (m *ParsedMessage) StartsEntry() bool {
+	return len(m.JSONPayload) > 0 || (m.TextPayload != "" && m.TextPayload[0] == '[')
+}
+
+// DatabaseID of the Cloud SQL instance that logged the entry, as project:instance
+func (m *ParsedMessage) DatabaseID() string {
+	return m.Resource.Labels["database_id"]
+}
+
+// Levels of the Cloud Logging severities, in increasing order of importance
+var severityLevels = map[string]int{
+	"DEFAULT":   0,
+	"DEBUG":     100,
+	"INFO":      200,
+	"NOTICE":    300,
+	"WARNING":   400,
+	"ERROR":     500,
+	"CRITICAL":  600,
+	"ALERT":     700,
+	"EMERGENCY": 800,
+}
+
+// SeverityLevel of a Cloud Logging severity name, and whether it is one
+func SeverityLevel(severity string) (int, bool) {
+	level, ok := severityLevels[severity]
+	return level, ok
+}
+
+// AtLeast reports whether the message is at least as severe as the given
+// level. Messages without a known severity never are.
+func (m *ParsedMessage) AtLeast(level int) bool {
+	l, ok := severityLevels[m.Severity]
+	return ok && l >= level
+}
+
+// Below reports whether the message is less severe than the given level.
+// Messages without a known severity never are.
+func (m *ParsedMessage) Below(level int) bool {
+	l, ok := severityLevels[m.Severity]
+	return ok && l < level
+}
+
+// SortTime of the message, which is its timestamp unless overridden
+func (m *ParsedMessage) SortTime() time.Time {
+	if !m.SortTimestamp.IsZero() {
+		return m.SortTimestamp
+	}
+	return m.Timestamp
+}
+
+// Less reports whether the message m should be emitted before the message o.
+// Messages are ordered by timestamp, with the insert ID and then the order in
+// which they were buffered as tiebreakers, so that messages sharing a
+// timestamp are always emitted in the same order. This is a strict order, so
+// the messages sharing an ordering key are kept in order by their sort time
+// instead.
+func (m *ParsedMessage) Less(o *ParsedMessage) bool {
+	mt, ot := m.SortTime(), o.SortTime()
+	if !mt.Equal(ot) {
+		return mt.Before(ot)
+	}
+
+	if m.InsertID != o.InsertID {
+		return m.InsertID < o.InsertID
+	}
+
+	return m.Seq < o.Seq
 }
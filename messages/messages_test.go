@@ -0,0 +1,34 @@
+package messages
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLessIsStrictOrder(t *testing.T) {
+	ts := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	msgs := []ParsedMessage{
+		{Timestamp: ts, OrderingKey: "k", InsertID: "z", Seq: 1},
+		{Timestamp: ts, OrderingKey: "k", InsertID: "a", Seq: 2},
+		{Timestamp: ts, InsertID: "m", Seq: 3},
+		{Timestamp: ts, InsertID: "m", Seq: 4},
+		{Timestamp: ts.Add(-time.Second), InsertID: "z", Seq: 5},
+		{Timestamp: ts, SortTimestamp: ts.Add(time.Nanosecond), OrderingKey: "k", InsertID: "a", Seq: 6},
+	}
+
+	for i := range msgs {
+		if msgs[i].Less(&msgs[i]) {
+			t.Errorf("message %d is less than itself", i)
+		}
+		for j := range msgs {
+			if msgs[i].Less(&msgs[j]) && msgs[j].Less(&msgs[i]) {
+				t.Errorf("messages %d and %d are both less than each other", i, j)
+			}
+			for k := range msgs {
+				if msgs[i].Less(&msgs[j]) && msgs[j].Less(&msgs[k]) && !msgs[i].Less(&msgs[k]) {
+					t.Errorf("message %d < %d < %d, but not %d < %d", i, j, k, i, k)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package messages
+
+import (
+	"strings"
+)
+
+// Lookup the value at the given dot-separated path (e.g. "entry.textPayload")
+// within a generic JSON document, as produced by json.Unmarshal
+func Lookup(doc interface{}, path string) (interface{}, bool) {
+	v := doc
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		v, ok = m[key]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return v, true
+}
+
+// LookupString at the given dot-separated path, if it holds a string
+func LookupString(doc interface{}, path string) (string, bool) {
+	v, ok := Lookup(doc, path)
+	if !ok {
+		return "", false
+	}
+
+	s, ok := v.(string)
+	return s, ok
+}
@@ -0,0 +1,44 @@
+package messages
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Reasons for which a message does not conform to the Cloud Logging schema
+const (
+	InvalidJSON      = "invalid_json"
+	InvalidTimestamp = "invalid_timestamp"
+	MissingPayload   = "missing_payload"
+)
+
+// schemaFields of a Cloud Logging entry that are required to be present
+type schemaFields struct {
+	Timestamp    *string         `json:"timestamp"`
+	TextPayload  *string         `json:"textPayload"`
+	JSONPayload  json.RawMessage `json:"jsonPayload"`
+	ProtoPayload json.RawMessage `json:"protoPayload"`
+}
+
+// Validate that the given message data is a Cloud Logging entry with a
+// timestamp and one of the payload fields, returning the reason if it is not
+// or an empty string if it is
+func Validate(data []byte) string {
+	var f schemaFields
+	if err := json.Unmarshal(data, &f); err != nil {
+		return InvalidJSON
+	}
+
+	if f.Timestamp == nil {
+		return InvalidTimestamp
+	}
+	if _, err := time.Parse(time.RFC3339Nano, *f.Timestamp); err != nil {
+		return InvalidTimestamp
+	}
+
+	if f.TextPayload == nil && f.JSONPayload == nil && f.ProtoPayload == nil {
+		return MissingPayload
+	}
+
+	return ""
+}